@@ -0,0 +1,133 @@
+package kademlia
+
+// Contains the procedure for joining an existing network through seed nodes.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// Outcome of a Bootstrap call.
+type BootstrapReport struct {
+	// seeds that answered the ping
+	Responded []Contact
+	// seeds that could not be reached, keyed by the address they were given as
+	Failed map[string]error
+}
+
+// Resolves a host:port address into the IP and port of a contact, preferring
+// an IPv4 address when the host has several.
+func ResolveAddress(addr string) (net.IP, uint16, error) {
+	hostname, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return nil, 0, errors.New("invalid port in " + addr)
+	}
+	ipAddrStrings, err := net.LookupHost(hostname)
+	if err != nil {
+		return nil, 0, err
+	}
+	var host net.IP
+	for i := 0; i < len(ipAddrStrings); i++ {
+		host = net.ParseIP(ipAddrStrings[i])
+		if host.To4() != nil {
+			break
+		}
+	}
+	return host, uint16(port), nil
+}
+
+// Joins the network through the given seeds, each a host:port address, and
+// through any contacts saved in Config.DataDir by a previous run. Every one
+// of them is pinged, which adds it to our routing table and us to theirs. A
+// lookup for our own ID then fills the buckets near us, and every bucket
+// farther away than our closest neighbour is refreshed.
+//
+// With no seeds and no saved contacts there is nothing to join and a new
+// network is started. An error is returned only if none of them answered,
+// or if ctx ends.
+func (k *Kademlia) Bootstrap(ctx context.Context, peers ...string) (*BootstrapReport, error) {
+	report := &BootstrapReport{Failed: make(map[string]error)}
+	if len(peers) == 0 && len(k.saved) == 0 {
+		return report, nil
+	}
+
+	// saved contacts are pinged along with the seeds, all at once
+	type pingResult struct {
+		peer    string
+		contact Contact
+		err     error
+	}
+	results := make(chan pingResult, len(peers)+len(k.saved))
+	for _, peer := range peers {
+		go func(peer string) {
+			host, port, err := ResolveAddress(peer)
+			if err != nil {
+				results <- pingResult{peer, Contact{}, err}
+				return
+			}
+			c, err := k.Ping(ctx, host, port)
+			results <- pingResult{peer, c, err}
+		}(peer)
+	}
+	for _, saved := range k.saved {
+		go func(saved Contact) {
+			peer := net.JoinHostPort(saved.Host.String(), strconv.Itoa(int(saved.Port)))
+			c, err := k.Ping(ctx, saved.Host, saved.Port)
+			results <- pingResult{peer, c, err}
+		}(saved)
+	}
+	for i := 0; i < len(peers)+len(k.saved); i++ {
+		res := <-results
+		if res.err != nil {
+			report.Failed[res.peer] = res.err
+		} else {
+			report.Responded = append(report.Responded, res.contact)
+		}
+	}
+	if len(report.Responded) == 0 {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		return report, errors.New("none of the seeds responded")
+	}
+
+	// lookups that come back empty are not fatal, the seeds are still known
+	k.IterativeFindNode(ctx, k.NodeID)
+	if ctx.Err() != nil {
+		return report, ctx.Err()
+	}
+
+	// refresh every bucket whose range lies entirely farther away than the
+	// closest neighbour, picking the IDs beforehand as the lookups may split
+	// buckets
+	targets := make([]ID, 0)
+	k.BucketMutexLock.Lock()
+	var closest *ID
+	for _, bucket := range k.BucketList {
+		for _, con := range bucket.ContactList {
+			distance := con.NodeID.Xor(k.NodeID)
+			if closest == nil || distance.Less(*closest) {
+				closest = &distance
+			}
+		}
+	}
+	for _, bucket := range k.BucketList {
+		if closest != nil && closest.Less(bucket.distanceFrom(k.NodeID)) {
+			targets = append(targets, bucket.RandomID())
+		}
+	}
+	k.BucketMutexLock.Unlock()
+	for _, target := range targets {
+		k.IterativeFindNode(ctx, target)
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+	}
+	return report, nil
+}
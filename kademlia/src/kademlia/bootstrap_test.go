@@ -0,0 +1,51 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBootstrap(t *testing.T) {
+	kad1 := NewKademlia("localhost:9037")
+	kad2 := NewKademlia("localhost:9038")
+	kad3 := NewKademlia("localhost:9039")
+	defer kad1.Close()
+	defer kad2.Close()
+	defer kad3.Close()
+	ctx := context.Background()
+
+	// the first node starts a new network
+	report, err := kad1.Bootstrap(ctx)
+	if err != nil || len(report.Responded) != 0 {
+		t.Fatal("TestBootstrap: Bootstrap without seeds failed:", err)
+	}
+
+	if _, err := kad2.Bootstrap(ctx, "localhost:9037"); err != nil {
+		t.Fatal("TestBootstrap: Bootstrap failed:", err)
+	}
+	report, err = kad3.Bootstrap(ctx, "localhost:9040", "localhost:9037")
+	if err != nil {
+		t.Fatal("TestBootstrap: Bootstrap failed:", err)
+	}
+	if len(report.Responded) != 1 || !report.Responded[0].NodeID.Equals(kad1.NodeID) {
+		t.Error("TestBootstrap: Seed that answered is not reported")
+	}
+	if _, ok := report.Failed["localhost:9040"]; !ok || len(report.Failed) != 1 {
+		t.Error("TestBootstrap: Dead seed is not reported")
+	}
+
+	// the seed learned about both nodes, and node 3 found node 2 through it
+	if _, err := kad1.FindContact(kad3.NodeID); err != nil {
+		t.Error("TestBootstrap: Seed did not add the joining node")
+	}
+	if _, err := kad3.FindContact(kad2.NodeID); err != nil {
+		t.Error("TestBootstrap: Joining node did not find the other node")
+	}
+	if _, err := kad2.FindContact(kad3.NodeID); err != nil {
+		t.Error("TestBootstrap: Other node did not learn about the joining node")
+	}
+
+	if _, err := kad3.Bootstrap(ctx, "localhost:9040", "not an address"); err == nil {
+		t.Error("TestBootstrap: Bootstrap with only dead seeds succeeded")
+	}
+}
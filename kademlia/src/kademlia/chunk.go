@@ -0,0 +1,165 @@
+package kademlia
+
+// Contains the client side of storing values larger than a single STORE
+// may carry. The payload is split into chunks of at most
+// Config.MaxValueSize bytes, each stored under its content key, and a
+// manifest listing the chunks is stored under the key the caller gave.
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Marks a value as a manifest, followed by the format version.
+var manifestMagic = []byte("KADM\x01")
+
+var errNotManifest = errors.New("value is not a manifest")
+
+// Lists the chunks a large value was split into, in order.
+type Manifest struct {
+	// length of the whole payload
+	Size   int64
+	Chunks []ID
+}
+
+// Encodes the manifest as the magic, the size and the chunk count as
+// uvarints, then the chunk IDs.
+func (m Manifest) encode() []byte {
+	buf := append([]byte(nil), manifestMagic...)
+	buf = binary.AppendUvarint(buf, uint64(m.Size))
+	buf = binary.AppendUvarint(buf, uint64(len(m.Chunks)))
+	for _, id := range m.Chunks {
+		buf = append(buf, id[:]...)
+	}
+	return buf
+}
+
+// Decodes a manifest of at most maxChunks chunks. The count is checked
+// before anything is allocated for it, since the value may come from anyone.
+func decodeManifest(buf []byte, maxChunks int) (Manifest, error) {
+	var m Manifest
+	if !bytes.HasPrefix(buf, manifestMagic) {
+		return m, errNotManifest
+	}
+	r := bytes.NewReader(buf[len(manifestMagic):])
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return m, errNotManifest
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(maxChunks) || count > uint64(r.Len())/IDBytes ||
+		count*IDBytes != uint64(r.Len()) {
+		return m, errNotManifest
+	}
+	m.Size = int64(size)
+	m.Chunks = make([]ID, count)
+	for i := range m.Chunks {
+		r.Read(m.Chunks[i][:])
+	}
+	return m, nil
+}
+
+// Runs fn for every index below n, at most alpha at a time, and returns the
+// first error any of them returned.
+func forEachParallel(n int, fn func(i int) error) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	slots := make(chan bool, alpha)
+	for i := 0; i < n; i++ {
+		slots <- true
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := fn(i); err != nil {
+				once.Do(func() { first = err })
+			}
+		}(i)
+	}
+	wg.Wait()
+	return first
+}
+
+// Splits data into chunks, stores each under its content key with an
+// iterative store, and then stores a manifest listing them under key. Fails
+// if a chunk or the manifest could not be stored on any node, or if the
+// manifest itself would be larger than Config.MaxValueSize.
+func (k *Kademlia) StoreChunked(ctx context.Context, key ID, data []byte) (Manifest, error) {
+	size := k.Config.MaxValueSize
+	m := Manifest{Size: int64(len(data))}
+	chunks := make([][]byte, 0, len(data)/size+1)
+	for start := 0; start < len(data); start += size {
+		end := start + size
+		if end > len(data) {
+			end = len(data)
+		}
+		id, err := ContentKey(k.Config.ContentHash, data[start:end])
+		if err != nil {
+			return m, err
+		}
+		chunks = append(chunks, data[start:end])
+		m.Chunks = append(m.Chunks, id)
+	}
+	manifest := m.encode()
+	if len(manifest) > size {
+		return m, fmt.Errorf("manifest of %d chunks is over the value size limit", len(chunks))
+	}
+
+	store := func(key ID, value []byte) error {
+		report, err := k.IterativeStore(ctx, key, value)
+		if err != nil {
+			return err
+		}
+		if len(report.Stored) == 0 {
+			return fmt.Errorf("%s was not stored on any node", key.AsString())
+		}
+		return nil
+	}
+	err := forEachParallel(len(chunks), func(i int) error {
+		return store(m.Chunks[i], chunks[i])
+	})
+	if err != nil {
+		return m, err
+	}
+	// the manifest goes last, so it never points at missing chunks
+	return m, store(key, manifest)
+}
+
+// Looks up the manifest under key, fetches its chunks in parallel and
+// returns the payload they add up to. Chunks are looked up with
+// FindContent, so every one is checked against its key.
+func (k *Kademlia) FindChunked(ctx context.Context, key ID) ([]byte, error) {
+	value, _, err := k.IterativeFindValue(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	// a manifest never holds more IDs than fit in one value
+	m, err := decodeManifest(value, k.Config.MaxValueSize/IDBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make([][]byte, len(m.Chunks))
+	err = forEachParallel(len(m.Chunks), func(i int) error {
+		chunk, _, err := k.FindContent(ctx, m.Chunks[i])
+		if err != nil {
+			return err
+		}
+		chunks[i] = chunk
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data := bytes.Join(chunks, nil)
+	if int64(len(data)) != m.Size {
+		return nil, fmt.Errorf("chunks add up to %d bytes, the manifest says %d", len(data), m.Size)
+	}
+	return data, nil
+}
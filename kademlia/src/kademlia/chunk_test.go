@@ -0,0 +1,136 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// Starts n nodes on a memory network with the given value size limit and
+// joins them.
+func newChunkNetwork(t *testing.T, n int, maxValueSize int) []*Kademlia {
+	network := NewMemoryNetwork()
+	config := DefaultConfig()
+	config.MaxValueSize = maxValueSize
+	nodes := make([]*Kademlia, n)
+	for i := range nodes {
+		config.Transport = network.Transport()
+		nodes[i] = NewKademliaWithConfig("", config)
+	}
+	joinNetwork(t, nodes)
+	return nodes
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	nodes := newChunkNetwork(t, 10, 1024)
+	for _, node := range nodes {
+		defer node.Close()
+	}
+	ctx := context.Background()
+
+	data := make([]byte, 10*1024+100)
+	rand.Read(data)
+	key := NewRandomID()
+	m, err := nodes[1].StoreChunked(ctx, key, data)
+	if err != nil {
+		t.Fatal("TestChunkedRoundTrip: StoreChunked failed:", err)
+	}
+	if len(m.Chunks) != 11 || m.Size != int64(len(data)) || m.Chunks[0] != sha1Key(data[:1024]) {
+		t.Fatalf("TestChunkedRoundTrip: Unexpected manifest, %d chunks of %d bytes", len(m.Chunks), m.Size)
+	}
+	decoded, err := decodeManifest(m.encode(), 1024/IDBytes)
+	if err != nil || decoded.Size != m.Size || len(decoded.Chunks) != len(m.Chunks) {
+		t.Error("TestChunkedRoundTrip: Manifest does not survive encoding:", err)
+	}
+
+	got, err := nodes[7].FindChunked(ctx, key)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatal("TestChunkedRoundTrip: FindChunked failed:", err)
+	}
+
+	// a plain value is not a manifest
+	key2 := NewRandomID()
+	if _, err := nodes[2].IterativeStore(ctx, key2, []byte("plain value")); err != nil {
+		t.Fatal("TestChunkedRoundTrip: IterativeStore failed:", err)
+	}
+	if _, err := nodes[7].FindChunked(ctx, key2); !errors.Is(err, errNotManifest) {
+		t.Error("TestChunkedRoundTrip: Plain value was taken for a manifest:", err)
+	}
+}
+
+func TestHostileManifest(t *testing.T) {
+	// a count of 2^62 chunks overflows count*IDBytes to 0
+	buf := append([]byte(nil), manifestMagic...)
+	buf = binary.AppendUvarint(buf, 0)
+	buf = binary.AppendUvarint(buf, 1<<62)
+	if _, err := decodeManifest(buf, 1024); err != errNotManifest {
+		t.Error("TestHostileManifest: Overflowing count was accepted:", err)
+	}
+
+	m := Manifest{Size: 3, Chunks: []ID{NewRandomID(), NewRandomID(), NewRandomID()}}
+	if _, err := decodeManifest(m.encode(), 2); err != errNotManifest {
+		t.Error("TestHostileManifest: Manifest over the chunk limit was accepted:", err)
+	}
+
+	// served by a node, it is refused rather than crashing the reader
+	nodes := newChunkNetwork(t, 3, 1024)
+	for _, node := range nodes {
+		defer node.Close()
+	}
+	ctx := context.Background()
+	key := NewRandomID()
+	if _, err := nodes[0].IterativeStore(ctx, key, buf); err != nil {
+		t.Fatal("TestHostileManifest: IterativeStore failed:", err)
+	}
+	if _, err := nodes[1].FindChunked(ctx, key); !errors.Is(err, errNotManifest) {
+		t.Error("TestHostileManifest: Hostile manifest was not refused:", err)
+	}
+}
+
+func TestChunkVerification(t *testing.T) {
+	nodes := newChunkNetwork(t, 5, 1024)
+	for _, node := range nodes {
+		defer node.Close()
+	}
+	ctx := context.Background()
+
+	// a manifest pointing at a chunk only stored under the wrong hash
+	chunk := []byte("the real chunk")
+	bogus := Manifest{Size: int64(len(chunk)), Chunks: []ID{sha1Key(chunk)}}
+	nodes[0].IterativeStore(ctx, sha1Key(chunk), []byte("something else"))
+	key := NewRandomID()
+	nodes[0].IterativeStore(ctx, key, bogus.encode())
+	var notFound *NotFoundError
+	if _, err := nodes[3].FindChunked(ctx, key); !errors.As(err, &notFound) {
+		t.Error("TestChunkVerification: Corrupt chunk was accepted:", err)
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	nodes := newChunkNetwork(t, 2, 1024)
+	for _, node := range nodes {
+		defer node.Close()
+	}
+	ctx := context.Background()
+
+	key := NewRandomID()
+	err := nodes[0].Store(ctx, &nodes[1].SelfContact, key, make([]byte, 1025))
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Kind != ErrRemote {
+		t.Fatal("TestMaxValueSize: Oversized STORE was not refused:", err)
+	}
+	if _, err := nodes[1].LocalValue(key); err == nil {
+		t.Error("TestMaxValueSize: Oversized value was stored")
+	}
+	if err := nodes[0].Store(ctx, &nodes[1].SelfContact, key, make([]byte, 1024)); err != nil {
+		t.Error("TestMaxValueSize: Value at the limit was refused:", err)
+	}
+
+	// the manifest of a large enough payload no longer fits
+	if _, err := nodes[0].StoreChunked(ctx, key, make([]byte, 1024*60)); err == nil {
+		t.Error("TestMaxValueSize: Oversized manifest was stored")
+	}
+}
@@ -0,0 +1,159 @@
+package kademlia
+
+// Contains the plumbing used to make outbound RPCs and the errors they return.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"time"
+)
+
+// A contact that fails this many RPCs in a row is evicted from its k-bucket.
+const maxFailures = 3
+
+// Why an RPC failed.
+type RPCErrorKind int
+
+const (
+	// the contact could not be reached, or dropped the connection
+	ErrUnreachable RPCErrorKind = iota
+	// the contact did not answer within Config.RPCTimeout
+	ErrTimeout
+	// the contact answered, but with an error
+	ErrRemote
+	// the caller's context was cancelled or ran out first
+	ErrCanceled
+)
+
+func (kind RPCErrorKind) String() string {
+	switch kind {
+	case ErrUnreachable:
+		return "unreachable"
+	case ErrTimeout:
+		return "timeout"
+	case ErrRemote:
+		return "remote error"
+	case ErrCanceled:
+		return "canceled"
+	}
+	return "unknown error"
+}
+
+// Returned by every outbound RPC that fails.
+type RPCError struct {
+	Kind    RPCErrorKind
+	Method  string
+	Contact Contact
+	Err     error
+}
+
+func (e *RPCError) Error() string {
+	address := e.Contact.Host.String() + ":" + strconv.Itoa(int(e.Contact.Port))
+	return e.Method + " to " + address + ": " + e.Kind.String() + ": " + e.Err.Error()
+}
+
+func (e *RPCError) Unwrap() error {
+	return e.Err
+}
+
+// Like rpc.DialHTTPPath, but gives up once ctx is done.
+func dialHTTPPath(ctx context.Context, address string, path string) (*rpc.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	// unblock the handshake below if ctx ends while it is running
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+
+	// the server answers the CONNECT before switching to RPC
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if ctx.Err() != nil {
+		// the deadline set above may have broken the handshake
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Sorts a failed call into one of the RPCErrorKinds. parent is the context
+// the caller passed in, before the per-RPC timeout was added to it.
+func classifyError(parent context.Context, err error) RPCErrorKind {
+	if parent.Err() != nil {
+		return ErrCanceled
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrTimeout
+	}
+	var serverErr rpc.ServerError
+	if errors.As(err, &serverErr) {
+		return ErrRemote
+	}
+	return ErrUnreachable
+}
+
+// Makes a single RPC to contact through the transport. The call gets its
+// own Config.RPCTimeout on top of any deadline already on ctx. Contacts that
+// cannot be reached are counted against their k-bucket.
+func (k *Kademlia) callRPC(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) (err error) {
+	start := time.Now()
+	defer func() {
+		k.metrics.rpcDone(method, time.Since(start), err)
+	}()
+	rpcCtx, cancel := context.WithTimeout(ctx, k.Config.RPCTimeout)
+	defer cancel()
+
+	if err := signMessage(k.privateKey, args); err != nil {
+		return err
+	}
+	err = k.transport.Call(rpcCtx, contact, method, args, reply)
+	if err != nil {
+		return k.rpcFailed(contact, method, classifyError(ctx, err), err)
+	}
+	// a reply that was not signed by the node we asked is as good as none
+	if err := k.verifyReply(args, reply, contact); err != nil {
+		return k.rpcFailed(contact, method, ErrRemote, err)
+	}
+	// pings go to an address, the ID they are answered from is the one
+	// that counts
+	id := contact.NodeID
+	if pong, ok := reply.(*PongMessage); ok {
+		id = pong.Sender.NodeID
+	}
+	k.recordRTT(id, time.Since(start))
+	return nil
+}
+
+// Wraps a failure in an RPCError. If the contact is to blame, the failure is
+// recorded and the contact evicted once it has failed maxFailures times.
+func (k *Kademlia) rpcFailed(contact *Contact, method string, kind RPCErrorKind, err error) error {
+	if kind == ErrUnreachable || kind == ErrTimeout {
+		k.RecordFailure(contact.NodeID)
+	}
+	return &RPCError{
+		Kind:    kind,
+		Method:  method,
+		Contact: *contact,
+		Err:     err,
+	}
+}
@@ -0,0 +1,121 @@
+package kademlia
+
+// Contains the settings a node can be created with.
+
+import (
+	"crypto/ed25519"
+	"time"
+)
+
+// Tunable settings for a Kademlia node. Fields left at their zero value are
+// replaced by the defaults below.
+type Config struct {
+	// at most this many pooled connections are kept open while idle
+	MaxIdleConns int
+	// pooled connections left idle longer than this are closed
+	IdleConnTimeout time.Duration
+	// how long a single RPC may take before the node is considered dead,
+	// independent of any deadline on the context passed in
+	RPCTimeout time.Duration
+	// buckets that have not been used for a lookup in this long are
+	// refreshed with a lookup of their own
+	RefreshInterval time.Duration
+	// lookups, including those done for STOREs, follow this many disjoint
+	// paths at once; 0 or 1 means a single path
+	DisjointPaths int
+	// full buckets that do not hold our own ID are still split while their
+	// depth is not a multiple of this, see routing.go; 0 or 1 means they
+	// never are
+	SplitBits int
+	// STOREs carrying a larger value are refused; StoreChunked splits
+	// values into chunks of this size
+	MaxValueSize int
+	// content keys, see content.go, are made with this hash function
+	ContentHash HashKind
+	// stored records expire this long after they were published
+	RecordTTL time.Duration
+	// copies cached along the path of a value lookup expire this long after
+	// they were cached, or with the original record if that is sooner
+	CacheTTL time.Duration
+	// how often expired records are deleted
+	SweepInterval time.Duration
+	// records not stored for this long are pushed to the k closest nodes
+	ReplicateInterval time.Duration
+	// values this node published are stored again after this long, which
+	// should be shorter than RecordTTL
+	RepublishInterval time.Duration
+	// where records are kept; a DiskStore in DataDir if one is set, a
+	// MemoryStore otherwise. The node closes it on Close.
+	Store Store
+	// carries RPCs to and from the node; an HTTPTransport if nil. The node
+	// closes it on Close.
+	Transport Transport
+	// the key the node signs its messages with, which its ID is derived
+	// from; the one saved in DataDir, or a new one, if nil
+	PrivateKey ed25519.PrivateKey
+	// if above 0, node IDs must solve the crypto puzzle in puzzle.go at this
+	// difficulty; contacts whose IDs do not are refused
+	IDDifficulty int
+	// if set, the REST gateway in gateway.go is served under /v1/ as well;
+	// this needs the HTTPTransport
+	Gateway bool
+	// if set, the node key, a snapshot of the routing table and the records
+	// are kept in this directory and reused on restart
+	DataDir string
+}
+
+const (
+	defaultMaxIdleConns    = 64
+	defaultIdleConnTimeout = 90 * time.Second
+	defaultRPCTimeout      = 5 * time.Second
+	defaultRefreshInterval = time.Hour
+	defaultMaxValueSize    = 64 << 10
+	// an hour of slack over the republish interval
+	defaultRecordTTL         = 25 * time.Hour
+	defaultCacheTTL          = time.Hour
+	defaultSweepInterval     = time.Minute
+	defaultReplicateInterval = time.Hour
+	defaultRepublishInterval = 24 * time.Hour
+)
+
+func DefaultConfig() Config {
+	var config Config
+	config.setDefaults()
+	return config
+}
+
+func (config *Config) setDefaults() {
+	if config.MaxIdleConns == 0 {
+		config.MaxIdleConns = defaultMaxIdleConns
+	}
+	if config.IdleConnTimeout == 0 {
+		config.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if config.RPCTimeout == 0 {
+		config.RPCTimeout = defaultRPCTimeout
+	}
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = defaultRefreshInterval
+	}
+	if config.MaxValueSize == 0 {
+		config.MaxValueSize = defaultMaxValueSize
+	}
+	if config.ContentHash == NoHash {
+		config.ContentHash = HashSHA1
+	}
+	if config.RecordTTL == 0 {
+		config.RecordTTL = defaultRecordTTL
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = defaultCacheTTL
+	}
+	if config.SweepInterval == 0 {
+		config.SweepInterval = defaultSweepInterval
+	}
+	if config.ReplicateInterval == 0 {
+		config.ReplicateInterval = defaultReplicateInterval
+	}
+	if config.RepublishInterval == 0 {
+		config.RepublishInterval = defaultRepublishInterval
+	}
+}
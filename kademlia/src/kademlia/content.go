@@ -0,0 +1,105 @@
+package kademlia
+
+// Contains the content key namespace, in which the key of a value is its
+// hash. A STORE whose key is the hash of its value says so, and the node it
+// goes to refuses it if the value does not hash to the key. Whatever the
+// STORE says, a node holding content under a key refuses to overwrite it
+// with a value that does not hash to that key. Lookups for content drop any
+// value that fails the same check and keep searching, so a node cannot serve
+// a forged value under someone else's content key.
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// The hash function content keys are made with.
+type HashKind byte
+
+const (
+	// the key is not derived from the value
+	NoHash HashKind = iota
+	HashSHA1
+	// SHA-256, cut down to the 160 bits of an ID
+	HashSHA256
+)
+
+var errContentMismatch = errors.New("value does not hash to its key")
+
+var errContentOverwrite = errors.New("key holds content, and the value does not hash to it")
+
+// Every hash function content keys can be made with.
+var hashKinds = []HashKind{HashSHA1, HashSHA256}
+
+// Returns the content key of value under the hash function kind.
+func ContentKey(kind HashKind, value []byte) (ID, error) {
+	var id ID
+	switch kind {
+	case HashSHA1:
+		id = sha1.Sum(value)
+	case HashSHA256:
+		sum := sha256.Sum256(value)
+		copy(id[:], sum[:])
+	default:
+		return id, fmt.Errorf("unknown hash kind %d", kind)
+	}
+	return id, nil
+}
+
+// Checks that value hashes to key under kind. Any value passes under NoHash.
+func verifyContent(kind HashKind, key ID, value []byte) error {
+	if kind == NoHash {
+		return nil
+	}
+	id, err := ContentKey(kind, value)
+	if err != nil {
+		return err
+	}
+	if id != key {
+		return errContentMismatch
+	}
+	return nil
+}
+
+// Returns the hash function under which value hashes to key, or NoHash if
+// there is none, that is if key is not the content key of value.
+func contentHash(key ID, value []byte) HashKind {
+	for _, kind := range hashKinds {
+		if verifyContent(kind, key, value) == nil {
+			return kind
+		}
+	}
+	return NoHash
+}
+
+// Returns the hash kind a STORE of value under key is marked with: the one
+// in Config.ContentHash if key is the value's content key, NoHash if not.
+func (k *Kademlia) contentKind(key ID, value []byte) HashKind {
+	if verifyContent(k.Config.ContentHash, key, value) == nil {
+		return k.Config.ContentHash
+	}
+	return NoHash
+}
+
+// Stores value under its content key, made with Config.ContentHash, and
+// returns the key along with the report of the iterative store.
+func (k *Kademlia) StoreContent(ctx context.Context, value []byte) (ID, *StoreReport, error) {
+	key, err := ContentKey(k.Config.ContentHash, value)
+	if err != nil {
+		return key, nil, err
+	}
+	report, err := k.IterativeStore(ctx, key, value)
+	return key, report, err
+}
+
+// Like IterativeFindValue, but for a content key made with
+// Config.ContentHash. Nodes that answer with a value that does not hash to
+// key are skipped as if they had not answered.
+func (k *Kademlia) FindContent(ctx context.Context, key ID) ([]byte, Contact, error) {
+	return k.findValue(ctx, key, func(value []byte) error {
+		return verifyContent(k.Config.ContentHash, key, value)
+	})
+}
@@ -0,0 +1,156 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+func sha1Key(value []byte) ID {
+	id, _ := ContentKey(HashSHA1, value)
+	return id
+}
+
+func TestContentKey(t *testing.T) {
+	value := []byte("content")
+	if id, err := ContentKey(HashSHA1, value); err != nil || id != ID(sha1.Sum(value)) {
+		t.Error("TestContentKey: Wrong SHA-1 key:", err)
+	}
+	sum := sha256.Sum256(value)
+	if id, err := ContentKey(HashSHA256, value); err != nil || !bytes.Equal(id[:], sum[:IDBytes]) {
+		t.Error("TestContentKey: Wrong SHA-256 key:", err)
+	}
+	if _, err := ContentKey(NoHash, value); err == nil {
+		t.Error("TestContentKey: NoHash made a key")
+	}
+	if verifyContent(HashSHA1, NewRandomID(), value) != errContentMismatch {
+		t.Error("TestContentKey: Wrong key was not detected")
+	}
+}
+
+func TestContentStoreIsVerified(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad1 := newMemoryNode(network, "")
+	kad2 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+	ctx := context.Background()
+
+	value := []byte("content")
+	key, report, err := kad1.StoreContent(ctx, value)
+	if err == nil {
+		t.Fatal("TestContentStoreIsVerified: StoreContent without contacts succeeded")
+	}
+	kad1.Ping(ctx, kad2.SelfContact.Host, kad2.SelfContact.Port)
+	key, report, err = kad1.StoreContent(ctx, value)
+	if err != nil || key != sha1Key(value) || len(report.Stored) != 1 {
+		t.Fatal("TestContentStoreIsVerified: StoreContent failed:", err)
+	}
+	if stored, _ := kad2.LocalValue(key); !bytes.Equal(stored, value) {
+		t.Error("TestContentStoreIsVerified: Content was not stored")
+	}
+
+	// a STORE in the content namespace whose value does not hash to its key
+	forged := NewRandomID()
+	req := &StoreRequest{Sender: kad1.SelfContact, MsgID: NewRandomID(), Key: forged, Value: value, Hash: HashSHA1}
+	var res StoreResult
+	err = kad1.callRPC(ctx, &kad2.SelfContact, "KademliaCore.Store", req, &res)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Kind != ErrRemote {
+		t.Fatal("TestContentStoreIsVerified: Forged content STORE was not refused:", err)
+	}
+	if _, err := kad2.LocalValue(forged); err == nil {
+		t.Error("TestContentStoreIsVerified: Forged content was stored")
+	}
+	// the same STORE outside the namespace is fine
+	req.Hash = NoHash
+	req.MsgID = NewRandomID()
+	if err := kad1.callRPC(ctx, &kad2.SelfContact, "KademliaCore.Store", req, &res); err != nil {
+		t.Error("TestContentStoreIsVerified: Plain STORE was refused:", err)
+	}
+}
+
+func TestFindContentSkipsForgedValues(t *testing.T) {
+	network := NewMemoryNetwork()
+	nodes := make([]*Kademlia, 10)
+	for i := range nodes {
+		nodes[i] = newMemoryNode(network, "")
+		defer nodes[i].Close()
+	}
+	joinNetwork(t, nodes)
+	ctx := context.Background()
+
+	value := []byte("the real value")
+	key := sha1Key(value)
+	byDistance := make([]*Kademlia, len(nodes))
+	copy(byDistance, nodes)
+	sort.Slice(byDistance, func(a, b int) bool {
+		return closerTo(key, byDistance[a].NodeID, byDistance[b].NodeID)
+	})
+
+	// the three closest nodes serve a forgery, the fourth the real value
+	for _, node := range byDistance[:3] {
+		if err := nodes[0].Store(ctx, &node.SelfContact, key, []byte("forged")); err != nil {
+			t.Fatal("TestFindContentSkipsForgedValues: Store failed:", err)
+		}
+	}
+	holder := byDistance[3]
+	if err := nodes[0].Store(ctx, &holder.SelfContact, key, value); err != nil {
+		t.Fatal("TestFindContentSkipsForgedValues: Store failed:", err)
+	}
+
+	found, from, err := byDistance[9].FindContent(ctx, key)
+	if err != nil || !bytes.Equal(found, value) {
+		t.Fatal("TestFindContentSkipsForgedValues: FindContent failed:", err)
+	}
+	if from.NodeID != holder.NodeID {
+		t.Error("TestFindContentSkipsForgedValues: Value came from the wrong node")
+	}
+}
+
+func TestContentCannotBeOverwritten(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad1 := newMemoryNode(network, "")
+	kad2 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+	ctx := context.Background()
+	kad1.Ping(ctx, kad2.SelfContact.Host, kad2.SelfContact.Port)
+
+	value := []byte("content")
+	key, _, err := kad1.StoreContent(ctx, value)
+	if err != nil {
+		t.Fatal("TestContentCannotBeOverwritten: StoreContent failed:", err)
+	}
+	// a newer STORE that does not claim to be content
+	req := &StoreRequest{Sender: kad1.SelfContact, MsgID: NewRandomID(), Key: key, Value: []byte("forged"),
+		Publisher: kad1.NodeID, Published: time.Now().Add(maxClockSkew / 2)}
+	var res StoreResult
+	err = kad1.callRPC(ctx, &kad2.SelfContact, "KademliaCore.Store", req, &res)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Kind != ErrRemote {
+		t.Error("TestContentCannotBeOverwritten: Overwrite of content was not refused:", err)
+	}
+	if stored, _ := kad2.LocalValue(key); !bytes.Equal(stored, value) {
+		t.Fatal("TestContentCannotBeOverwritten: Content was overwritten")
+	}
+
+	// the other way round, content replaces a forgery even if that is newer
+	other := []byte("other content")
+	otherKey := sha1Key(other)
+	req.MsgID, req.Key = NewRandomID(), otherKey
+	if err := kad1.callRPC(ctx, &kad2.SelfContact, "KademliaCore.Store", req, &res); err != nil {
+		t.Fatal("TestContentCannotBeOverwritten: Plain STORE failed:", err)
+	}
+	if _, _, err := kad1.StoreContent(ctx, other); err != nil {
+		t.Fatal("TestContentCannotBeOverwritten: StoreContent failed:", err)
+	}
+	if stored, _ := kad2.LocalValue(otherKey); !bytes.Equal(stored, other) {
+		t.Error("TestContentCannotBeOverwritten: Content did not replace a forgery")
+	}
+}
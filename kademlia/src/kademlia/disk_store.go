@@ -0,0 +1,342 @@
+package kademlia
+
+// Contains a Store that survives restarts by keeping an append-only log of
+// every change on disk.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	opPut    = byte(1)
+	opDelete = byte(2)
+	// a put of a cached copy, see Record.Cached
+	opPutCached = byte(3)
+
+	// the log is not compacted before it holds this many entries
+	minCompactEntries = 1024
+)
+
+// Store that keeps its records in memory and logs every Put and Delete to a
+// file, synced before the call returns. Opening the file replays the log;
+// an entry torn by a crash is detected by its checksum and dropped. Once
+// most of the log is made up of overwritten or deleted records it is
+// compacted, by writing the live records to a new file and renaming it over
+// the old one. A write that fails is cut off the log again; if that fails
+// too, or a sync fails, the state of the log is unknown and the store
+// refuses all further changes.
+type DiskStore struct {
+	mutex   sync.RWMutex
+	path    string
+	file    *os.File
+	records map[ID]Record
+	// entries in the log, live or not
+	entries int
+	failed  error
+}
+
+// Opens the log at path, creating it if needed.
+func OpenDiskStore(path string) (*DiskStore, error) {
+	s := new(DiskStore)
+	s.path = path
+	s.records = make(map[ID]Record)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	good, err := s.replay(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// drop whatever follows the last complete entry
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+// Applies every complete entry in f and returns the offset just past the
+// last one.
+func (s *DiskStore) replay(f *os.File) (int64, error) {
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return good, nil
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return good, nil
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return good, nil
+		}
+		op, key, rec, err := decodeEntry(payload)
+		if err != nil {
+			return good, nil
+		}
+		if op == opPut {
+			s.records[key] = rec
+		} else {
+			delete(s.records, key)
+		}
+		s.entries++
+		good += int64(len(header) + len(payload))
+	}
+}
+
+func encodeTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func decodeTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Encodes a log entry as a length and checksum followed by the payload.
+func encodeEntry(op byte, key ID, rec Record) []byte {
+	payload := make([]byte, 0, 1+2*IDBytes+3*8+4+len(rec.Value))
+	if op == opPut && rec.Cached {
+		op = opPutCached
+	}
+	payload = append(payload, op)
+	payload = append(payload, key[:]...)
+	if op != opDelete {
+		var num [8]byte
+		payload = append(payload, rec.Publisher[:]...)
+		for _, t := range []time.Time{rec.Published, rec.Expires, rec.Stored} {
+			binary.BigEndian.PutUint64(num[:], uint64(encodeTime(t)))
+			payload = append(payload, num[:]...)
+		}
+		binary.BigEndian.PutUint32(num[:4], uint32(len(rec.Value)))
+		payload = append(payload, num[:4]...)
+		payload = append(payload, rec.Value...)
+	}
+
+	entry := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(entry[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(entry[4:8], crc32.ChecksumIEEE(payload))
+	return append(entry, payload...)
+}
+
+func decodeEntry(payload []byte) (op byte, key ID, rec Record, err error) {
+	if len(payload) < 1+IDBytes {
+		return 0, key, rec, errors.New("log entry too short")
+	}
+	op = payload[0]
+	copy(key[:], payload[1:1+IDBytes])
+	rest := payload[1+IDBytes:]
+	switch op {
+	case opDelete:
+		return op, key, rec, nil
+	case opPut, opPutCached:
+		rec.Cached = op == opPutCached
+		if len(rest) < IDBytes+3*8+4 {
+			return 0, key, rec, errors.New("log entry too short")
+		}
+		copy(rec.Publisher[:], rest[:IDBytes])
+		rest = rest[IDBytes:]
+		rec.Published = decodeTime(int64(binary.BigEndian.Uint64(rest[0:8])))
+		rec.Expires = decodeTime(int64(binary.BigEndian.Uint64(rest[8:16])))
+		rec.Stored = decodeTime(int64(binary.BigEndian.Uint64(rest[16:24])))
+		size := binary.BigEndian.Uint32(rest[24:28])
+		rest = rest[28:]
+		if uint32(len(rest)) != size {
+			return 0, key, rec, errors.New("log entry has the wrong length")
+		}
+		rec.Value = make([]byte, size)
+		copy(rec.Value, rest)
+		return opPut, key, rec, nil
+	}
+	return 0, key, rec, errors.New("unknown log entry")
+}
+
+// Appends an entry and syncs it to disk. Must hold the write lock.
+func (s *DiskStore) append(op byte, key ID, rec Record) error {
+	if s.file == nil {
+		return errors.New("store is closed")
+	}
+	if s.failed != nil {
+		return s.failed
+	}
+	end, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(encodeEntry(op, key, rec)); err != nil {
+		s.rollback(end)
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		s.failed = err
+		return err
+	}
+	s.entries++
+	return nil
+}
+
+// Cuts off whatever part of an entry was written past end, so that the next
+// one does not land behind it. Must hold the write lock.
+func (s *DiskStore) rollback(end int64) {
+	err := s.file.Truncate(end)
+	if err == nil {
+		_, err = s.file.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		s.failed = err
+	}
+}
+
+// Compacts the log once most of it is dead. Called after records has been
+// updated for the last entry, since compact writes out records and not the
+// log. Must hold the write lock.
+func (s *DiskStore) maybeCompact() error {
+	if s.entries >= minCompactEntries && s.entries > 2*len(s.records) {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *DiskStore) Get(key ID) (Record, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	rec, ok := s.records[key]
+	return rec, ok, nil
+}
+
+func (s *DiskStore) Put(key ID, rec Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.append(opPut, key, rec); err != nil {
+		return err
+	}
+	s.records[CopyID(key)] = rec
+	return s.maybeCompact()
+}
+
+func (s *DiskStore) Delete(key ID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.records[key]; !ok {
+		return nil
+	}
+	if err := s.append(opDelete, key, Record{}); err != nil {
+		return err
+	}
+	delete(s.records, key)
+	return s.maybeCompact()
+}
+
+func (s *DiskStore) Iterate(fn func(key ID, rec Record) bool) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for key, rec := range s.records {
+		if !fn(key, rec) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *DiskStore) Size() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.records)
+}
+
+// Rewrites the log so that it only holds the live records.
+func (s *DiskStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return errors.New("store is closed")
+	}
+	if s.failed != nil {
+		return s.failed
+	}
+	return s.compact()
+}
+
+// Syncs the directory holding path, which makes a rename in it durable.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *DiskStore) compact() error {
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for key, rec := range s.records {
+		if _, err = w.Write(encodeEntry(opPut, key, rec)); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		// the old log stays intact until the rename replaces it
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.file.Close()
+	s.file = tmp
+	s.entries = len(s.records)
+	// until the directory is synced, a crash may bring back the old log
+	return syncDir(s.path)
+}
+
+func (s *DiskStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
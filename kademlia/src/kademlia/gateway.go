@@ -0,0 +1,205 @@
+package kademlia
+
+// Contains the REST gateway, which lets programs that cannot speak net/rpc
+// store and look up values over HTTP and JSON:
+//
+//	PUT /v1/keys/{id}    body {"Value": base64}, runs an iterative store
+//	GET /v1/keys/{id}    runs an iterative find-value
+//	GET /v1/nodes/{id}   returns the k closest contacts to id
+//
+// IDs are 40 hex digits. Errors come back as {"Error": message} with a
+// matching status code. Values over Config.MaxValueSize are refused with 413.
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A contact as the gateway reports it.
+type GatewayContact struct {
+	NodeID string
+	Host   string
+	Port   uint16
+}
+
+type GatewayPutRequest struct {
+	Value []byte
+}
+
+type GatewayPutResponse struct {
+	Key    string
+	Stored []GatewayContact
+	// errors keyed by the ID of the node that did not acknowledge
+	Failed map[string]string
+}
+
+type GatewayGetResponse struct {
+	Key    string
+	Value  []byte
+	Holder GatewayContact
+}
+
+type GatewayNodesResponse struct {
+	NodeID   string
+	Contacts []GatewayContact
+}
+
+type gatewayError struct {
+	Error string
+}
+
+func gatewayContact(c Contact) GatewayContact {
+	return GatewayContact{NodeID: c.NodeID.AsString(), Host: c.Host.String(), Port: c.Port}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, gatewayError{err.Error()})
+}
+
+// Parses the {id} of a gateway path. Unlike IDFromString it wants all 40
+// digits.
+func gatewayID(idstr string) (ID, error) {
+	var id ID
+	raw, err := hex.DecodeString(idstr)
+	if err != nil || len(raw) != IDBytes {
+		return id, errors.New("ID must be 40 hex digits")
+	}
+	copy(id[:], raw)
+	return id, nil
+}
+
+// Picks the status code for an error out of a lookup.
+func lookupErrorCode(err error) int {
+	var notFound *NotFoundError
+	switch {
+	case errors.As(err, &notFound):
+		return http.StatusNotFound
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// Returns a handler serving the gateway. With Config.Gateway set and the
+// default HTTPTransport it is already served under /v1/ on the node's
+// listener.
+func (k *Kademlia) GatewayHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+		if len(parts) != 2 || (parts[0] != "keys" && parts[0] != "nodes") {
+			writeError(w, http.StatusNotFound, errors.New("no such resource"))
+			return
+		}
+		id, err := gatewayID(parts[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		switch {
+		case parts[0] == "keys" && r.Method == http.MethodPut:
+			k.gatewayPut(w, r, id)
+		case parts[0] == "keys" && r.Method == http.MethodGet:
+			k.gatewayGet(w, r, id)
+		case parts[0] == "nodes" && r.Method == http.MethodGet:
+			k.gatewayNodes(w, r, id)
+		default:
+			if parts[0] == "keys" {
+				w.Header().Set("Allow", "GET, PUT")
+			} else {
+				w.Header().Set("Allow", "GET")
+			}
+			writeError(w, http.StatusMethodNotAllowed, errors.New(r.Method+" is not allowed here"))
+		}
+	})
+}
+
+func (k *Kademlia) gatewayPut(w http.ResponseWriter, r *http.Request, key ID) {
+	max := k.Config.MaxValueSize
+	// base64 takes 4 bytes for every 3, plus room for the JSON around it
+	limit := int64(4*(max+2)/3 + 1024)
+	if r.ContentLength > limit {
+		// refused before the body is read, so a client that sent Expect:
+		// 100-continue never sends it
+		writeError(w, http.StatusRequestEntityTooLarge, errors.New("request body is too large"))
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, limit)
+	var req GatewayPutRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, errors.New("request body is too large"))
+		} else {
+			writeError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+	if len(req.Value) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("Value is empty"))
+		return
+	}
+	if len(req.Value) > max {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("Value is over the limit of %d bytes", max))
+		return
+	}
+
+	report, err := k.IterativeStore(r.Context(), key, req.Value)
+	if err != nil {
+		// no node to store on is the network's fault, not the key's
+		code := lookupErrorCode(err)
+		if code == http.StatusNotFound {
+			code = http.StatusServiceUnavailable
+		}
+		writeError(w, code, err)
+		return
+	}
+	res := GatewayPutResponse{
+		Key:    key.AsString(),
+		Stored: make([]GatewayContact, 0, len(report.Stored)),
+		Failed: make(map[string]string),
+	}
+	for _, con := range report.Stored {
+		res.Stored = append(res.Stored, gatewayContact(con))
+	}
+	for _, failure := range report.Failed {
+		res.Failed[failure.Contact.NodeID.AsString()] = failure.Err.Error()
+	}
+	if len(report.Stored) == 0 {
+		writeJSON(w, http.StatusBadGateway, res)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (k *Kademlia) gatewayGet(w http.ResponseWriter, r *http.Request, key ID) {
+	value, holder, err := k.IterativeFindValue(r.Context(), key)
+	if err != nil {
+		writeError(w, lookupErrorCode(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, GatewayGetResponse{key.AsString(), value, gatewayContact(holder)})
+}
+
+func (k *Kademlia) gatewayNodes(w http.ResponseWriter, r *http.Request, id ID) {
+	contacts, err := k.IterativeFindNode(r.Context(), id)
+	if err != nil {
+		writeError(w, lookupErrorCode(err), err)
+		return
+	}
+	res := GatewayNodesResponse{NodeID: id.AsString(), Contacts: make([]GatewayContact, 0, len(contacts))}
+	for _, con := range contacts {
+		res.Contacts = append(res.Contacts, gatewayContact(con))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,114 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Makes a gateway request to handler and decodes the JSON reply into res, if
+// not nil.
+func gatewayCall(t *testing.T, handler http.Handler, method string, path string, body interface{}, res interface{}) int {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(method, path, &buf))
+	if res != nil {
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			t.Fatal("gatewayCall: Decoding failed:", err)
+		}
+	}
+	return resp.Code
+}
+
+func TestGateway(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad1 := newMemoryNode(network, "")
+	kad2 := newMemoryNode(network, "")
+	kad3 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+	defer kad3.Close()
+	gateway := kad1.GatewayHandler()
+	url := "/v1/"
+
+	key := NewRandomID()
+	var errRes gatewayError
+	if code := gatewayCall(t, gateway, "PUT", url+"keys/"+key.AsString(), GatewayPutRequest{[]byte("rest")}, &errRes); code != http.StatusServiceUnavailable {
+		t.Error("TestGateway: PUT without any contacts gave", code, errRes.Error)
+	}
+
+	for _, kad := range []*Kademlia{kad2, kad3} {
+		if _, err := kad.Ping(context.Background(), kad1.SelfContact.Host, kad1.SelfContact.Port); err != nil {
+			t.Fatal("TestGateway: Ping failed:", err)
+		}
+	}
+
+	var put GatewayPutResponse
+	if code := gatewayCall(t, gateway, "PUT", url+"keys/"+key.AsString(), GatewayPutRequest{[]byte("rest")}, &put); code != http.StatusOK {
+		t.Fatal("TestGateway: PUT gave", code)
+	}
+	if put.Key != key.AsString() || len(put.Stored) != 2 || len(put.Failed) != 0 {
+		t.Errorf("TestGateway: PUT reported %+v", put)
+	}
+
+	var get GatewayGetResponse
+	if code := gatewayCall(t, gateway, "GET", url+"keys/"+key.AsString(), nil, &get); code != http.StatusOK {
+		t.Fatal("TestGateway: GET gave", code)
+	}
+	if !bytes.Equal(get.Value, []byte("rest")) || get.Holder.Port == 0 {
+		t.Errorf("TestGateway: GET reported %+v", get)
+	}
+	if code := gatewayCall(t, gateway, "GET", url+"keys/"+NewRandomID().AsString(), nil, &errRes); code != http.StatusNotFound {
+		t.Error("TestGateway: GET of a missing key gave", code)
+	}
+
+	var nodes GatewayNodesResponse
+	if code := gatewayCall(t, gateway, "GET", url+"nodes/"+key.AsString(), nil, &nodes); code != http.StatusOK {
+		t.Fatal("TestGateway: GET nodes gave", code)
+	}
+	if len(nodes.Contacts) != 2 {
+		t.Errorf("TestGateway: GET nodes reported %+v", nodes)
+	}
+
+	if code := gatewayCall(t, gateway, "GET", url+"keys/1234", nil, &errRes); code != http.StatusBadRequest || errRes.Error == "" {
+		t.Error("TestGateway: Short ID gave", code)
+	}
+	if code := gatewayCall(t, gateway, "PUT", url+"keys/"+key.AsString(), GatewayPutRequest{}, &errRes); code != http.StatusBadRequest {
+		t.Error("TestGateway: Empty value gave", code)
+	}
+	max := kad1.Config.MaxValueSize
+	if code := gatewayCall(t, gateway, "PUT", url+"keys/"+key.AsString(), GatewayPutRequest{make([]byte, max+1)}, &errRes); code != http.StatusRequestEntityTooLarge {
+		t.Error("TestGateway: Value over the limit gave", code)
+	}
+	if code := gatewayCall(t, gateway, "PUT", url+"keys/"+key.AsString(), GatewayPutRequest{make([]byte, 2*max)}, &errRes); code != http.StatusRequestEntityTooLarge {
+		t.Error("TestGateway: Body over the limit gave", code)
+	}
+	if code := gatewayCall(t, gateway, "DELETE", url+"keys/"+key.AsString(), nil, nil); code != http.StatusMethodNotAllowed {
+		t.Error("TestGateway: DELETE gave", code)
+	}
+}
+
+func TestGatewayIsServedWhenEnabled(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		config := DefaultConfig()
+		config.Gateway = enabled
+		kad := NewKademliaWithConfig("localhost:0", config)
+		defer kad.Close()
+		url := "http://" + hostPort(kad.SelfContact.Host, kad.SelfContact.Port) + "/v1/keys/1234"
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal("TestGatewayIsServedWhenEnabled: GET failed:", err)
+		}
+		resp.Body.Close()
+		// a gateway refuses the short ID, anything else has no such page
+		if served := resp.StatusCode == http.StatusBadRequest; served != enabled {
+			t.Errorf("TestGatewayIsServedWhenEnabled: With Config.Gateway %v, GET gave %d", enabled, resp.StatusCode)
+		}
+	}
+}
@@ -4,36 +4,55 @@ package kademlia
 // as a receiver for the RPC methods, which is required by that package.
 
 import (
+	"context"
+	"crypto/ed25519"
 	"fmt"
 	"log"
 	"net"
-	"net/http"
-	"net/rpc"
 	"strconv"
 	"sync"
-	"time"
 	"math"
 	"bytes"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 const (
 	alpha        = 3
 	b            = 8 * IDBytes
 	k            = 20
-	bucket_count = 160
+
+	// k, for methods where the name is taken by the *Kademlia receiver
+	kSize = k
 )
 
 // Kademlia type. You can put whatever state you need in this.
 type Kademlia struct {
 	NodeID          ID
 	SelfContact     Contact
-	BucketList      []KBucket
-	Table           map[ID][]byte
+	// the routing table, sorted by Prefix; together the buckets cover the
+	// whole ID space
+	BucketList      []*KBucket
+	Table           Store
 	Vdos			map[ID]VanishingDataObject
 	TableMutexLock  sync.Mutex
-	BucketMutexLock [bucket_count]sync.Mutex
+	BucketMutexLock sync.Mutex
 	vdoMutexLock	sync.Mutex
 	LastTimeout		int64
+	Config          Config
+	privateKey      ed25519.PrivateKey
+	transport       Transport
+	refreshMutexLock sync.Mutex
+	stopRefresh     context.CancelFunc
+	// values this node published, kept for republishing; in
+	// Config.DataDir if there is one, so republishing survives a restart
+	published       Store
+	republishMutexLock sync.Mutex
+	stopRepublish   context.CancelFunc
+	// contacts saved in Config.DataDir by a previous run
+	saved           []Contact
+	metrics         *nodeMetrics
 }
 
 type ContactWrapper struct {
@@ -46,78 +65,172 @@ type ValueWrapper struct {
 	Contact 		Contact
 	KnownContacts	[]Contact
 	Value 			[]byte
+	// who published Value and when
+	Publisher		ID
+	Published		time.Time
 	Error 			error
 }
 
+// Result of an iterative store.
+type StoreReport struct {
+	Key    ID
+	Stored []Contact
+	Failed []StoreFailure
+}
+
+// A node that did not acknowledge a STORE, and why.
+type StoreFailure struct {
+	Contact Contact
+	Err     error
+}
+
+// Starts a node with the default configuration, exiting the program if it
+// cannot.
 func NewKademlia(laddr string) *Kademlia {
+	return NewKademliaWithConfig(laddr, DefaultConfig())
+}
+
+// Like OpenKademlia, but exits the program if the node cannot be started.
+func NewKademliaWithConfig(laddr string, config Config) *Kademlia {
+	k, err := OpenKademlia(laddr, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return k
+}
+
+// Starts a node listening on laddr. Fails if the data directory or the key
+// in it cannot be used, or if the transport cannot listen; nothing the node
+// opened is left open then.
+func OpenKademlia(laddr string, config Config) (*Kademlia, error) {
 	k := new(Kademlia)
-	k.NodeID = NewRandomID()
-	// only 160 nodes in this system
-	k.BucketList = make([]KBucket, bucket_count)
+	config.setDefaults()
+	k.privateKey = config.PrivateKey
+	// stores opened here, to be closed again if the node does not start
+	opened := make([]Store, 0, 2)
+	fail := func(what string, err error) (*Kademlia, error) {
+		for _, s := range opened {
+			s.Close()
+		}
+		return nil, fmt.Errorf("%s: %w", what, err)
+	}
+	if config.DataDir != "" {
+		// reuse the identity and contacts of the last run
+		if err := os.MkdirAll(config.DataDir, 0770); err != nil {
+			return fail("DataDir", err)
+		}
+		var err error
+		if k.privateKey == nil {
+			k.privateKey, err = loadOrCreateKey(config.DataDir, config.IDDifficulty)
+			if err != nil {
+				return fail("DataDir", err)
+			}
+		}
+		k.saved, err = loadContacts(config.DataDir)
+		if err != nil {
+			return fail("DataDir", err)
+		}
+		if config.Store == nil {
+			config.Store, err = OpenDiskStore(filepath.Join(config.DataDir, storeFile))
+			if err != nil {
+				return fail("DataDir", err)
+			}
+			opened = append(opened, config.Store)
+		}
+		k.published, err = OpenDiskStore(filepath.Join(config.DataDir, publishedFile))
+		if err != nil {
+			return fail("DataDir", err)
+		}
+		opened = append(opened, k.published)
+	}
+	if k.privateKey == nil {
+		var err error
+		k.privateKey, err = GenerateIdentity(config.IDDifficulty)
+		if err != nil {
+			return fail("GenerateIdentity", err)
+		}
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryStore()
+	}
+	k.Config = config
+	publicKey := k.privateKey.Public().(ed25519.PublicKey)
+	k.NodeID = NodeIDFromPublicKey(publicKey)
+	if err := k.checkPuzzle(k.NodeID); err != nil {
+		return fail("PrivateKey", err)
+	}
 
 	// initialize the data entry table
-	k.Table = make(map[ID][]byte)
+	k.Table = config.Store
+	if k.published == nil {
+		k.published = NewMemoryStore()
+	}
 
 	// initialize Vdos map
 	k.Vdos = make(map[ID]VanishingDataObject)
+	k.metrics = newNodeMetrics()
 
-	// initialize all k-buckets
-	for i := 0; i < b; i++ {
-		k.BucketList[i].Initialize()
-	}
+	// the routing table starts out as a single bucket covering every ID,
+	// see UpdateContactInKBucket for how it grows
+	root := new(KBucket)
+	root.Initialize()
+	k.BucketList = []*KBucket{root}
 
 	// Set up RPC server
 	// NOTE: KademliaCore is just a wrapper around Kademlia. This type includes
 	// the RPC functions.
-	/*
-		rpc.Register(&KademliaCore{k})
-		rpc.HandleHTTP()
-		l, err := net.Listen("tcp", laddr)
-		if err != nil {
-			log.Fatal("Listen: ", err)
-		}
-		// Run RPC server forever.
-		go http.Serve(l, nil)
-	*/
-	s := rpc.NewServer() // Create a new RPC server
-	s.Register(&KademliaCore{k})
-	_, port, _ := net.SplitHostPort(laddr)                           // extract just the port number
-	s.HandleHTTP(rpc.DefaultRPCPath+port, rpc.DefaultDebugPath+port) // I'm making a unique RPC path for this instance of Kademlia
-
-	l, err := net.Listen("tcp", laddr)
+	k.transport = config.Transport
+	if k.transport == nil {
+		k.transport = NewHTTPTransport(config.MaxIdleConns, config.IdleConnTimeout)
+	}
+	host, port, err := k.transport.Listen(laddr)
 	if err != nil {
-		log.Fatal("Listen: ", err)
+		return fail("Listen", err)
 	}
-	// Run RPC server forever.
-	go http.Serve(l, nil)
 
 	// Add self contact
-	hostname, port, _ := net.SplitHostPort(l.Addr().String())
-	port_int, _ := strconv.Atoi(port)
-	ipAddrStrings, err := net.LookupHost(hostname)
-	var host net.IP
-	for i := 0; i < len(ipAddrStrings); i++ {
-		host = net.ParseIP(ipAddrStrings[i])
-		if host.To4() != nil {
-			break
+	k.SelfContact = Contact{k.NodeID, host, port, publicKey}
+	k.transport.Serve(&KademliaCore{k})
+	if t, ok := k.transport.(*HTTPTransport); ok {
+		t.Handle("/metrics", k.MetricsHandler())
+		t.Handle("/status", k.StatusHandler())
+		t.Handle("/status.json", k.StatusJSONHandler())
+		if config.Gateway {
+			t.Handle("/v1/", k.GatewayHandler())
 		}
 	}
-	k.SelfContact = Contact{k.NodeID, host, uint16(port_int)}
-	return k
+
+	k.StartRefresher()
+	k.StartRepublisher()
+	return k, nil
 }
 
-func (k *Kademlia) FindKBucket(nodeId ID) (bucket *KBucket, index int) {
-	prefixLen := k.NodeID.Xor(nodeId).PrefixLen()
-	if prefixLen == 160 {
-		index = 0
-	} else {
-		index = 159 - prefixLen
+// Stops serving RPCs, stops the background work, saves the routing table
+// if there is a data directory and closes the transport and the store.
+func (k *Kademlia) Close() error {
+	k.StopRefresher()
+	k.StopRepublisher()
+	err := k.SaveContacts()
+	if terr := k.transport.Close(); err == nil {
+		err = terr
+	}
+	if serr := k.Table.Close(); err == nil {
+		err = serr
+	}
+	if perr := k.published.Close(); err == nil {
+		err = perr
 	}
-	k.BucketMutexLock[index].Lock()
-	bucket = &(k.BucketList[index])
-	k.BucketMutexLock[index].Unlock()
+	return err
+}
 
-	return bucket, index
+// Returns the bucket whose range nodeId falls into, and its index in
+// BucketList. The bucket may be split, and the index change, as soon as
+// BucketMutexLock is released.
+func (k *Kademlia) FindKBucket(nodeId ID) (bucket *KBucket, index int) {
+	k.BucketMutexLock.Lock()
+	defer k.BucketMutexLock.Unlock()
+	index = k.bucketIndex(nodeId)
+	return k.BucketList[index], index
 }
 
 type NotFoundError struct {
@@ -134,13 +247,13 @@ func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 	if nodeId == k.NodeID {
 		return &k.SelfContact, nil
 	}
-	for i := 0; i < len(k.BucketList); i++ {
-		kb := k.BucketList[i]
-		for j := 0; j < len(kb.ContactList); j++ {
-			c := kb.ContactList[j]
-			if c.NodeID.Equals(nodeId) {
-				return &c, nil
-			}
+	k.BucketMutexLock.Lock()
+	defer k.BucketMutexLock.Unlock()
+	bucket := k.BucketList[k.bucketIndex(nodeId)]
+	for j := 0; j < len(bucket.ContactList); j++ {
+		c := bucket.ContactList[j]
+		if c.NodeID.Equals(nodeId) {
+			return &c, nil
 		}
 	}
 	err := new(NotFoundError)
@@ -148,513 +261,458 @@ func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 	return nil, err
 }
 
-// This is the function to perform the RPC
-func (k *Kademlia) DoPing(host net.IP, port uint16) string {
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	port_str := strconv.Itoa(int(port))
-	address := host.String() + ":" + port_str
-	client, err := rpc.DialHTTPPath("tcp", address, rpc.DefaultRPCPath+port_str)
-	if err != nil {
-		log.Fatal("ERR: ", err)
-	}
-
-	// create new ping to send to the other node
+// Pings host:port and returns the contact that answered.
+func (k *Kademlia) Ping(ctx context.Context, host net.IP, port uint16) (Contact, error) {
 	ping := new(PingMessage)
 	ping.Sender = k.SelfContact
 	ping.MsgID = NewRandomID()
-	ping.Sender = k.SelfContact
+
 	var pong PongMessage
-	err = client.Call("KademliaCore.Ping", ping, &pong)
+	err := k.callRPC(ctx, &Contact{Host: host, Port: port}, "KademliaCore.Ping", ping, &pong)
 	if err != nil {
-		log.Fatal("ERR: ", err)
+		return Contact{}, err
 	}
 
 	// update contact in kbucket of this kademlia
-	updated := pong.Sender
-	k.UpdateContactInKBucket(&updated)
-	// find kbucket that should hold this contact
-
-	return "OK: Contact updated in KBucket"
+	k.UpdateContactInKBucket(&pong.Sender)
+	return pong.Sender, nil
 }
 
-func (k *Kademlia) DoStore(contact *Contact, key ID, value []byte) string {
+// This is the function to perform the RPC
+func (k *Kademlia) DoPing(ctx context.Context, host net.IP, port uint16) string {
 	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	port_str := strconv.Itoa(int(contact.Port))
-	address := contact.Host.String() + ":" + port_str
-	client, err := rpc.DialHTTPPath("tcp", address, rpc.DefaultRPCPath+port_str)
-
-	if err != nil {
-		log.Fatal("ERR: ", err)
-	}
-	request := new(StoreRequest)
-	request.Sender = *contact
-	request.Key = key
-	request.Value = value
-	request.MsgID = NewRandomID()
-
-	var result StoreResult
-	err = client.Call("KademliaCore.Store", request, &result)
+	_, err := k.Ping(ctx, host, port)
 	if err != nil {
-		log.Fatal("ERR: ", err)
+		return "ERR: " + err.Error()
 	}
-
-	// update contact in kbucket of this kademlia
-	k.UpdateContactInKBucket(contact)
-
 	return "OK: Contact updated in KBucket"
 }
 
-func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) string {
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	port_str := strconv.Itoa(int(contact.Port))
-	address := contact.Host.String() + ":" + port_str
-	client, err := rpc.DialHTTPPath("tcp", address, rpc.DefaultRPCPath+port_str)
+// Sends a single STORE to contact and waits for it to be acknowledged. The
+// value is stored as published by this node, now.
+func (k *Kademlia) Store(ctx context.Context, contact *Contact, key ID, value []byte) error {
+	rec := Record{Value: value, Publisher: k.NodeID, Published: time.Now()}
+	return k.storeRecord(ctx, contact, key, rec)
+}
 
+func (k *Kademlia) DoStore(ctx context.Context, contact *Contact, key ID, value []byte) string {
+	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+	err := k.Store(ctx, contact, key, value)
 	if err != nil {
-		log.Fatal("ERR: ", err)
+		return "ERR: " + err.Error()
 	}
+	return "OK: Contact updated in KBucket"
+}
 
+// Asks contact for the nodes it knows closest to searchKey.
+func (k *Kademlia) FindNode(ctx context.Context, contact *Contact, searchKey ID) ([]Contact, error) {
 	request := new(FindNodeRequest)
-	request.Sender = *contact
+	request.Sender = k.SelfContact
 	request.NodeID = searchKey
 	request.MsgID = NewRandomID()
 
 	var result FindNodeResult
-	err = client.Call("KademliaCore.FindNode", request, &result)
+	err := k.callRPC(ctx, contact, "KademliaCore.FindNode", request, &result)
+	if err == nil && result.Err != nil {
+		err = &RPCError{
+			Kind:    ErrRemote,
+			Method:  "KademliaCore.FindNode",
+			Contact: *contact,
+			Err:     result.Err,
+		}
+	}
 	if err != nil {
-		log.Fatal("ERR: ", err)
+		return nil, err
 	}
 
-	if result.Err != nil {
-		return "ERR: Error occurred in FindNode RPC"
-	}
 	// update contact in kbucket of this kademlia
 	k.UpdateContactInKBucket(contact)
+	return result.Nodes, nil
+}
+
+func (k *Kademlia) DoFindNode(ctx context.Context, contact *Contact, searchKey ID) string {
+	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+	nodes, err := k.FindNode(ctx, contact, searchKey)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
 
-	// jwhang: taken directly from print_contact in main.go
-	// probably a bad idea. need to abstract it out
-	response := "OK:\n"
 	count := 0
-	found := false
-	for i := 0; i < len(result.Nodes); i++ {
-		c := result.Nodes[i]
+	for _, c := range nodes {
 		if c.Host != nil {
-			found = true
 			count += 1
 		}
 	}
-
-	if found {
-		return response + " Found " + strconv.Itoa(count) + " Contacts"
-	} else {
+	if count == 0 {
 		return "ERR: NOT FOUND"
 	}
+	return "OK:\n Found " + strconv.Itoa(count) + " Contacts"
 }
 
-func (k *Kademlia) DoFindValue(contact *Contact, searchKey ID) string {
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	port_str := strconv.Itoa(int(contact.Port))
-	address := contact.Host.String() + ":" + port_str
-	client, err := rpc.DialHTTPPath("tcp", address, rpc.DefaultRPCPath+port_str)
-
+// Asks contact for the value stored under searchKey. If contact does not
+// have it, the value is nil and the closest nodes it knows are returned
+// instead.
+func (k *Kademlia) FindValue(ctx context.Context, contact *Contact, searchKey ID) ([]byte, []Contact, error) {
+	result, err := k.findValueRPC(ctx, contact, searchKey)
 	if err != nil {
-		log.Fatal("ERR: ", err)
+		return nil, nil, err
+	}
+	if len(result.Value) == 0 {
+		return nil, result.Nodes, nil
 	}
+	return result.Value, nil, nil
+}
 
+// Sends a single FIND_VALUE and returns the whole reply.
+func (k *Kademlia) findValueRPC(ctx context.Context, contact *Contact, searchKey ID) (*FindValueResult, error) {
 	request := new(FindValueRequest)
-	request.Sender = *contact
+	request.Sender = k.SelfContact
 	request.Key = searchKey
 	request.MsgID = NewRandomID()
 
 	var result FindValueResult
-	err = client.Call("KademliaCore.FindValue", request, &result)
+	err := k.callRPC(ctx, contact, "KademliaCore.FindValue", request, &result)
+	if err == nil && result.Err != nil {
+		err = &RPCError{
+			Kind:    ErrRemote,
+			Method:  "KademliaCore.FindValue",
+			Contact: *contact,
+			Err:     result.Err,
+		}
+	}
 	if err != nil {
-		log.Fatal("ERR: ", err)
+		return nil, err
 	}
 
 	// update contact in kbucket of this kademlia
-	if result.Err != nil {
-		return "ERR: Error occurred in FindValue RPC"
+	k.UpdateContactInKBucket(contact)
+	return &result, nil
+}
+
+func (k *Kademlia) DoFindValue(ctx context.Context, contact *Contact, searchKey ID) string {
+	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+	value, _, err := k.FindValue(ctx, contact, searchKey)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	if value == nil {
+		return "ERR: Value not found"
 	}
+	return "OK: " + string(value)
+}
 
-	k.UpdateContactInKBucket(contact)
-	return "OK: " + string(result.Value)
+// Returns the value stored under searchKey on this node.
+func (k *Kademlia) LocalValue(searchKey ID) ([]byte, error) {
+	val := k.getRecord(searchKey)
+	if len(val) == 0 {
+		err := new(NotFoundError)
+		err.id = searchKey
+		err.msg = "Value not found in local table"
+		return nil, err
+	}
+	return val, nil
 }
 
 func (k *Kademlia) LocalFindValue(searchKey ID) string {
 	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	val := k.Table[searchKey]
-	if val == nil || len(val) == 0 {
+	val, err := k.LocalValue(searchKey)
+	if err != nil {
 		return "ERR: Value not found in local table"
 	}
 
 	return "OK: " + string(val)
 }
 
-func (k *Kademlia) DoIterativeFindNode(id ID) string {
-	kContacts := k.DoIterativeFindNodeWrapper(id)
-	res := ""
+func (k *Kademlia) DoIterativeFindNode(ctx context.Context, id ID) string {
+	kContacts, err := k.IterativeFindNode(ctx, id)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	res := "OK:\n"
 
-	count := 0
-	for _, con := range kContacts {
+	for count, con := range kContacts {
 		res += "--Triple " + strconv.Itoa(count) + "--\n"
 		res += "NodeID = " + con.NodeID.AsString() + "\n"
 		res += "Host = " + con.Host.String() + "\n"
-		res += "Port = " + strconv.Itoa(int(con.Port))
+		res += "Port = " + strconv.Itoa(int(con.Port)) + "\n"
 		res += "-------------\n"
 	}
 	return res
 }
 
-func (k *Kademlia) DoIterativeFindNodeWrapper(id ID) []Contact {
-	// For project 2!
-	shortlist := make(map[ID]bool)
-	lookup := make(map[ID]Contact)
-	contacted := make([]Contact, 0, 20)
-	contacts := k.FindCloseContacts(id)
-	timeout := make(chan bool, 1)
-	//closest := contacts[0]
-
-	initialLength := len(contacts)
-	var lim int
-	if initialLength < alpha { // FindCloseContacts might return < 3 nodes
-		lim = initialLength
-	} else {
-		lim = alpha
+// Returns the k closest live contacts to id, sorted by distance.
+func (k *Kademlia) IterativeFindNode(ctx context.Context, id ID) ([]Contact, error) {
+	list, _, err := k.iterativeLookup(ctx, id, func(ctx context.Context, con Contact) ValueWrapper {
+		c := make(chan ContactWrapper, 1)
+		k.SendRPCFindNode(ctx, &con, id, c)
+		res := <-c
+		return ValueWrapper{
+			Contact:       res.Contact,
+			KnownContacts: res.KnownContacts,
+			Error:         res.Error,
+		}
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	for i := 0; i < lim; i++ {
-		shortlist[contacts[i].NodeID] = false
-		lookup[contacts[i].NodeID] = contacts[i]
+	contacts := list.live()
+	if len(contacts) == 0 {
+		err := new(NotFoundError)
+		err.id = id
+		err.msg = "No contacts found"
+		return nil, err
 	}
+	return contacts, nil
+}
 
-	c := make(chan ContactWrapper)
-	stopIter := false
-
-	go func() {	// set timeout
-		time.Sleep(5 * time.Second)
-		timeout <- true
-	}()
-
-	for len(contacted) < 20 && !stopIter {
-		fmt.Println("WHERE AM I")
-		toContact := make([]Contact, 3)
-
-		count := 0
-		for s_contact_id, _ := range shortlist {
-			if count > alpha {
-				break
-			} else if !alreadyContacted(contacted, lookup[s_contact_id]){
-				toContact = append(toContact, lookup[s_contact_id])
-				count += 1
-			}
-		}
-
-		for _, con := range toContact {
-			go k.SendRPCFindNode(&con, id, c)
-		}
+func (k *Kademlia) DoIterativeFindNodeWrapper(ctx context.Context, id ID) []Contact {
+	contacts, _ := k.IterativeFindNode(ctx, id)
+	return contacts
+}
 
-		// time.Sleep(1e9)
-		
-		stopIter = true
-
-		for i := 0; i < alpha; i++ {
-			//res := <- c
-			select {
-			case res:= <-c:
-				if res.Error != nil {
-					for index, newContact := range res.KnownContacts {
-						if newContact.NodeID.Equals(res.Contact.NodeID) {
-							res.KnownContacts = append(res.KnownContacts[:index], res.KnownContacts[i+1:]...)
-							break
-						}
-					}
-					continue
-				}
-				for _, con := range res.KnownContacts {
-					contacted = append(contacted, con)
-				}
-			case <- timeout:
-				stopIter = true
-				//timeout
-			}
-		}
+func (k *Kademlia) SendRPCFindNode(ctx context.Context, target *Contact, id ID, c chan ContactWrapper) {
+	cont := Contact{
+		NodeID:    CopyID(target.NodeID),
+		Host:      target.Host,
+		Port:      target.Port,
+		PublicKey: target.PublicKey,
+	}
+	nodes, err := k.FindNode(ctx, &cont, id)
+	c <- ContactWrapper{
+		Contact:       cont,
+		KnownContacts: nodes,
+		Error:         err,
 	}
-	return contacted // TODO: change this to printable string
 }
 
-func (k *Kademlia) SendRPCFindNode(target * Contact, id ID, c chan ContactWrapper) {
-	
-	cont := Contact {	
-		NodeID: CopyID(target.NodeID),
-		Host: target.Host,
-		Port: target.Port,
+func (k *Kademlia) SendRPCFindValue(ctx context.Context, target *Contact, key ID, c chan ValueWrapper) {
+	cont := Contact{
+		NodeID:    CopyID(target.NodeID),
+		Host:      target.Host,
+		Port:      target.Port,
+		PublicKey: target.PublicKey,
 	}
-	port_str := strconv.Itoa(int(cont.Port))
-	address := cont.Host.String() + ":" + port_str
-	client, _ := rpc.DialHTTPPath("tcp", address, rpc.DefaultRPCPath+port_str)
-
-	request := new(FindNodeRequest)
-	request.Sender = cont
-	request.NodeID = id
-	request.MsgID = NewRandomID()
-
-	var result FindNodeResult
-	err := client.Call("KademliaCore.FindNode", request, &result)
+	res := ValueWrapper{Contact: cont}
+	result, err := k.findValueRPC(ctx, &cont, key)
 	if err != nil {
-		cWrapper := ContactWrapper {
-			Error : err,
-		}
-		c <- cWrapper
+		res.Error = err
+	} else if len(result.Value) == 0 {
+		res.KnownContacts = result.Nodes
 	} else {
-		k.UpdateContactInKBucket(&cont)
-		fmt.Println(len(result.Nodes))
-		cWrapper := ContactWrapper {
-			Contact : cont,
-			KnownContacts : result.Nodes,
-		}
-		c <- cWrapper
+		res.Value = result.Value
+		res.Publisher = result.Publisher
+		res.Published = result.Published
 	}
+	c <- res
 }
 
-func (k *Kademlia) SendRPCFindValue(target * Contact, id ID, c chan ValueWrapper) {
-	fmt.Println("HERE")
-	
-	cont := Contact {
-		NodeID: CopyID(target.NodeID),
-		Host: target.Host,
-		Port: target.Port,
-	}
-	fmt.Println(cont.NodeID.AsString())
-
-	port_str := strconv.Itoa(int(cont.Port))
-	address := cont.Host.String() + ":" + port_str
-	client, err := rpc.DialHTTPPath("tcp", address, rpc.DefaultRPCPath+port_str)
+func (k *Kademlia) DoIterativeStore(ctx context.Context, key ID, value []byte) string {
+	report, err := k.IterativeStore(ctx, key, value)
 	if err != nil {
-		log.Fatal("ERR: ", err)
+		return "ERR: " + err.Error()
 	}
-	/*
-	request := new(FindNodeRequest)
-	request.Sender = cont
-	request.NodeID = id
-	request.MsgID = NewRandomID()
-	*/
 
-	request := FindNodeRequest {
-		Sender: cont,
-		NodeID: id,
-		MsgID: NewRandomID(),
+	res := "OK: Stored at " + strconv.Itoa(len(report.Stored)) + " of " +
+		strconv.Itoa(len(report.Stored)+len(report.Failed)) + " nodes\n"
+	for _, con := range report.Stored {
+		res += "Stored at: " + con.NodeID.AsString() + "\n"
 	}
-
-	var result FindValueResult
-	err = client.Call("KademliaCore.FindValue", request, &result)
-	if err != nil {
-		fmt.Println("*********")
-		fmt.Println(len(result.Nodes))
-		fmt.Println(result.Err)
-		vWrapper := ValueWrapper {
-			Contact: cont,
-			KnownContacts: result.Nodes,
-			Error: err,
-		}
-		c <- vWrapper
-		fmt.Println("PIKA")
-	} else {
-		k.UpdateContactInKBucket(&cont)
-		vWrapper := ValueWrapper {
-			Contact: cont,
-			Value: result.Value,
-			Error: nil,
-		}
-		c <- vWrapper
-		fmt.Println("AAAAAAAAAAA")
+	for _, failure := range report.Failed {
+		res += "Failed at: " + failure.Contact.NodeID.AsString() + " (" + failure.Err.Error() + ")\n"
 	}
+	return res
 }
 
-func (k *Kademlia) DoIterativeStore(key ID, value []byte) string {
-	// For project 2!
-	triples := k.DoIterativeFindNodeWrapper(k.NodeID)
-	var lastSent ID
-
-	for _, con := range triples {
-		k.DoStore(&con, key, value)
-		lastSent = con.NodeID
+// Finds the k closest nodes to key and stores the value on all of them at
+// once. The report lists which nodes acknowledged the STORE and which did not.
+// The value is republished every Config.RepublishInterval from then on.
+func (k *Kademlia) IterativeStore(ctx context.Context, key ID, value []byte) (*StoreReport, error) {
+	// remember the value so it can be republished before it expires
+	rec := Record{Value: value, Publisher: k.NodeID, Published: time.Now()}
+	k.TableMutexLock.Lock()
+	err := k.published.Put(key, rec)
+	k.TableMutexLock.Unlock()
+	if err != nil {
+		return nil, err
 	}
-
-	return "Final Store occurred at: " + lastSent.AsString()
+	return k.iterativeStore(ctx, key, rec)
 }
 
-func (k *Kademlia) DoIterativeFindValue(key ID) string {
-	// For project 2!
-	fmt.Println("HAHAHAHAHA")
-	shortlist := make(map[ID]bool)
-	lookup := make(map[ID]Contact)
-	contacted := make([]Contact, 0, 20)
-	timeout := make(chan bool, 1)
-	id := k.NodeID
-	//contacted := make(map[Contact]bool)
-	var lim int
-	contacts := k.FindCloseContacts(id)
-	initialLength := len(contacts)
+// Like IterativeStore, but the value is never republished and expires
+// Config.RecordTTL from now, as the shares of a VDO must.
+func (k *Kademlia) IterativeStoreOnce(ctx context.Context, key ID, value []byte) (*StoreReport, error) {
+	rec := Record{Value: value, Publisher: k.NodeID, Published: time.Now()}
+	return k.iterativeStore(ctx, key, rec)
+}
 
-	if initialLength < alpha {
-		lim = initialLength
-	} else {
-		lim = alpha
+func (k *Kademlia) iterativeStore(ctx context.Context, key ID, rec Record) (*StoreReport, error) {
+	contacts, err := k.IterativeFindNode(ctx, key)
+	if err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < lim; i++ {
-		shortlist[contacts[i].NodeID] = false
-		lookup[contacts[i].NodeID] = contacts[i]
+	type storeAck struct {
+		contact Contact
+		err     error
+	}
+	acks := make(chan storeAck, len(contacts))
+	for _, con := range contacts {
+		go func(con Contact) {
+			acks <- storeAck{con, k.storeRecord(ctx, &con, key, rec)}
+		}(con)
 	}
 
-	c := make(chan ValueWrapper)
-	stopIter := false
-	fmt.Println(len(contacted))
-
-	var resultContact Contact
-	var resultValue []byte
-
-	for len(contacted) < 20 && !stopIter {
-		toContact := make([]Contact, 0, 3)
-		count := 0
-		for s_contact_id, visited := range shortlist {
-			if count > alpha {
-				break;
-			} else if !visited {
-				toContact = append(toContact, lookup[s_contact_id])
-				count += 1
-			}
+	report := new(StoreReport)
+	report.Key = key
+	for range contacts {
+		ack := <-acks
+		if ack.err != nil {
+			report.Failed = append(report.Failed, StoreFailure{ack.contact, ack.err})
+		} else {
+			report.Stored = append(report.Stored, ack.contact)
 		}
+	}
+	return report, nil
+}
 
-		go func() {
-			time.Sleep(5 * time.Second)
-			timeout <- true
-		}()
+func (k *Kademlia) DoIterativeFindValue(ctx context.Context, key ID) string {
+	value, holder, err := k.IterativeFindValue(ctx, key)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	return "OK: \nID: " + holder.NodeID.AsString() + " \nValue: " + string(value)
+}
 
-		for _, con := range toContact {
-			go k.SendRPCFindValue(&con, id, c)
-			shortlist[con.NodeID] = true
-			delete(lookup, con.NodeID)
-		}
+// Looks up key on the network. Returns the value along with the contact that
+// served it. Once found, the value is cached on the closest node that was
+// queried and did not have it. The cached copy keeps the original publisher
+// and publish time, and expires after Config.CacheTTL.
+func (k *Kademlia) IterativeFindValue(ctx context.Context, key ID) ([]byte, Contact, error) {
+	return k.findValue(ctx, key, nil)
+}
 
-		//stopIter = true
-
-		for i := 0; i < alpha; i++ {
-			select {
-			case res := <- c:
-				if res.Error != nil {
-					fmt.Println("....")
-					fmt.Println(len(res.KnownContacts))
-					for index, newContact := range res.KnownContacts {
-						fmt.Println(index)
-						fmt.Println(newContact.NodeID.AsString())
-						if newContact.NodeID.Equals(res.Contact.NodeID) {
-							res.KnownContacts = append(res.KnownContacts[:index], res.KnownContacts[i+1:]...)
-							break
-						}
-						shortlist[newContact.NodeID] = false
-						lookup[newContact.NodeID] = newContact
-						stopIter = false
-					}
-					continue
-				} else {
-					// value is found
-					stopIter = true
-					fmt.Println("HEREHERE")
-					resultContact = Contact {
-						NodeID: CopyID(res.Contact.NodeID),
-						Host: res.Contact.Host,
-						Port: res.Contact.Port,
-					}
-					resultValue = res.Value
-					return "OK: \nID: " + resultContact.NodeID.AsString() + " \nValue: " + string(resultValue)
-				}
-			case <- timeout:
-				stopIter = true
-				break
+// Runs IterativeFindValue. If check is not nil, values it returns an error
+// for are dropped and the lookup goes on without the node that sent them.
+func (k *Kademlia) findValue(ctx context.Context, key ID, check func([]byte) error) ([]byte, Contact, error) {
+	list, found, err := k.iterativeLookup(ctx, key, func(ctx context.Context, con Contact) ValueWrapper {
+		c := make(chan ValueWrapper, 1)
+		k.SendRPCFindValue(ctx, &con, key, c)
+		res := <-c
+		if res.Value != nil && check != nil {
+			if err := check(res.Value); err != nil {
+				return ValueWrapper{Contact: res.Contact, Error: err}
 			}
 		}
-	}
-	return "SHIT"
-}
-
-func (k *Kademlia) UpdateContactInKBucket(update *Contact) {
-	bucket, index := k.FindKBucket(update.NodeID)
-	k.BucketMutexLock[index].Lock()
-	err := bucket.Update(*update)
-	k.BucketMutexLock[index].Unlock()
+		return res
+	})
 	if err != nil {
-		first := k.BucketList[index].ContactList[0]
-		status := k.DoPing(first.Host, first.Port)
-		if status[0:2] != "OK" {
-			k.BucketList[err.index].RemoveContact(first.NodeID)
-			k.BucketList[err.index].AddContact(&(k.BucketList[err.index].ContactList), err.updated)
+		return nil, Contact{}, err
+	}
+	if found == nil {
+		err := new(NotFoundError)
+		err.id = key
+		err.msg = "Value not found"
+		return nil, Contact{}, err
+	}
+
+	for _, con := range list.live() {
+		if !con.NodeID.Equals(found.Contact.NodeID) {
+			k.storeRecord(ctx, &con, key, Record{
+				Value:     found.Value,
+				Publisher: found.Publisher,
+				Published: found.Published,
+				Cached:    true,
+			})
+			break
 		}
 	}
+	return found.Value, found.Contact, nil
 }
 
-// jwhang: updates each contact
-func (k *Kademlia) UpdateContacts(contact Contact) {
-	prefixLen := k.NodeID.Xor(contact.NodeID).PrefixLen()
-	if prefixLen == 160 {
-		prefixLen = 0
-	}
-
-	k.BucketMutexLock[prefixLen].Lock()
-	currentBucket := k.BucketList[prefixLen]
-	currentBucket.Update(contact)
-	k.BucketMutexLock[prefixLen].Unlock()
+// Counts a failed RPC against the contact with the given ID, evicting it from
+// its k-bucket once it has failed maxFailures times in a row.
+func (k *Kademlia) RecordFailure(nodeId ID) {
+	k.BucketMutexLock.Lock()
+	k.BucketList[k.bucketIndex(nodeId)].RecordFailure(nodeId)
+	k.BucketMutexLock.Unlock()
+}
 
+// Remembers how long an RPC to the contact with the given ID took, if the
+// contact is in the routing table.
+func (k *Kademlia) recordRTT(nodeId ID, rtt time.Duration) {
+	k.BucketMutexLock.Lock()
+	defer k.BucketMutexLock.Unlock()
+	bucket := k.BucketList[k.bucketIndex(nodeId)]
+	if exists, _ := bucket.ContainsContact(Contact{NodeID: nodeId}); exists {
+		bucket.RTT[nodeId] = rtt
+	}
 }
 
-// nsg622: finds closest nodes
-// assumes closest nodes are in the immediate kbucket and the next one
-func (k *Kademlia) FindCloseContacts(key ID) []Contact {
-	prefixLen := k.NodeID.Xor(key).PrefixLen()
-	var index int
-	if prefixLen == 160 {
-		index = 0
-	} else {
-		index = 159 - prefixLen
+// Adds a contact that was just heard from to the routing table, or moves it
+// to the tail of its bucket if it is there already. A full bucket that can
+// be split, see splittable, is split until the contact fits.
+func (k *Kademlia) UpdateContactInKBucket(update *Contact) {
+	if update.NodeID.Equals(k.NodeID) {
+		// we are not in our own routing table
+		return
 	}
-	contacts := make([]Contact, 0, 20)
-	for _, val := range k.BucketList[index].ContactList {
-		contacts = append(contacts, val)
+	if k.checkPuzzle(update.NodeID) != nil {
+		return
 	}
-
-	if len(contacts) == 20 {
-		return contacts
+	k.BucketMutexLock.Lock()
+	index := k.bucketIndex(update.NodeID)
+	bucket := k.BucketList[index]
+	err := bucket.Update(*update)
+	for err != nil && k.splittable(bucket) {
+		k.splitBucket(index)
+		index = k.bucketIndex(update.NodeID)
+		bucket = k.BucketList[index]
+		err = bucket.Update(*update)
+	}
+	if err == nil {
+		k.BucketMutexLock.Unlock()
+		return
+	}
+
+	// The bucket is full. Keep the new contact around in case the least
+	// recently seen one turns out to be dead, and check on that one without
+	// holding up the caller, which may be an RPC handler.
+	bucket.AddReplacement(err.updated)
+	head := bucket.ContactList[0]
+	check := !bucket.checkingHead
+	bucket.checkingHead = true
+	k.BucketMutexLock.Unlock()
+	if check {
+		go k.checkHead(head)
 	}
+}
 
-	// algorithm to add k elements to contacts slice and return it
-	left := index
-	right := index
-	for {
-		if left == 0 && right == 159 {
-			return contacts
-		}
-		if left != 0 {
-			left -= 1
-		}
-		if right != 159 {
-			right += 1
-		}
-
-		for _, val := range k.BucketList[right].ContactList {
-			if val.Host != nil {
-				contacts = append(contacts, val)
-			}
-		}
+// Pings the least recently seen contact of a full bucket. If it answers, the
+// ping moves it to the tail of the bucket. If not, it is replaced by the
+// freshest contact in the replacement cache.
+func (k *Kademlia) checkHead(head Contact) {
+	pong, err := k.Ping(context.Background(), head.Host, head.Port)
+	alive := err == nil && pong.NodeID.Equals(head.NodeID)
 
-		for _, val := range k.BucketList[left].ContactList {
-			if val.Host != nil {
-				contacts = append(contacts, val)
-			}
-		}
+	k.BucketMutexLock.Lock()
+	defer k.BucketMutexLock.Unlock()
+	bucket := k.BucketList[k.bucketIndex(head.NodeID)]
+	bucket.checkingHead = false
+	if alive {
+		return
+	}
+	if bucket.RemoveContact(head.NodeID) {
+		bucket.forget(head.NodeID)
+		bucket.PromoteReplacement()
 	}
 }
 
+// Returns the k contacts closest to key, sorted by distance. The requester is
+// left out, it has no use for its own contact.
+func (k *Kademlia) FindCloseContacts(key ID, requester ID) []Contact {
+	return k.ClosestContacts(key, kSize, requester)
+}
+
 func FindDistance(keyOne ID, keyTwo ID) int {
 	return keyOne.Xor(keyTwo).PrefixLen()
 }
@@ -5,11 +5,14 @@ package kademlia
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 	// "fmt"
 )
 
@@ -50,7 +53,6 @@ var hostIP = getHostIP()
 func TestStore(t *testing.T) {
 	kc := new(KademliaCore)
 	kc.kademlia = NewKademlia("localhost:9000")
-	senderID := NewRandomID()
 	messageID := NewRandomID()
 	key, err := IDFromString("1234567890123456789012345678901234567890")
 	if err != nil {
@@ -58,11 +60,7 @@ func TestStore(t *testing.T) {
 		t.Fail()
 	}
 	value := []byte("somedata")
-	con := Contact{
-		NodeID: senderID,
-		Host:   net.IPv4(0x01, 0x02, 0x03, 0x04),
-		Port:   9000,
-	}
+	con, senderKey := newTestSender(net.IPv4(0x01, 0x02, 0x03, 0x04), 9000)
 	req := StoreRequest{
 		Sender: con,
 		MsgID:  messageID,
@@ -70,6 +68,7 @@ func TestStore(t *testing.T) {
 		Value:  value,
 	}
 	res := new(StoreResult)
+	signMessage(senderKey, &req)
 	err = kc.Store(req, res)
 	if err != nil {
 		t.Error("TestStore: Failed to store key-value pair")
@@ -79,7 +78,7 @@ func TestStore(t *testing.T) {
 		t.Error("TestStore: MessageID Doesn't match")
 		t.Fail()
 	}
-	if bytes.Equal((*kc).kademlia.Table[key], value) == false {
+	if bytes.Equal((*kc).kademlia.getRecord(key), value) == false {
 		t.Error("TestStore: Value stored is incorrect")
 		t.Fail()
 	}
@@ -88,15 +87,10 @@ func TestStore(t *testing.T) {
 func TestLocalFindValue(t *testing.T) {
 	kc := new(KademliaCore)
 	kc.kademlia = NewKademlia("localhost:8000")
-	senderID := NewRandomID()
 	messageID := NewRandomID()
 	key := NewRandomID()
 	value := []byte("somevalue")
-	con := Contact{
-		NodeID: senderID,
-		Host:   net.IPv4(0x01, 0x02, 0x03, 0x04),
-		Port:   9000,
-	}
+	con, senderKey := newTestSender(net.IPv4(0x01, 0x02, 0x03, 0x04), 9000)
 	req := StoreRequest{
 		Sender: con,
 		MsgID:  messageID,
@@ -104,6 +98,7 @@ func TestLocalFindValue(t *testing.T) {
 		Value:  value,
 	}
 	res := new(StoreResult)
+	signMessage(senderKey, &req)
 	err := kc.Store(req, res)
 	if err != nil {
 		t.Error("TestLocalFindValue: Failed to store the key-value pair")
@@ -121,18 +116,14 @@ func TestLocalFindValue(t *testing.T) {
 func TestStoreKeyWithFindValue(t *testing.T) {
 	kc := new(KademliaCore)
 	kc.kademlia = NewKademlia("localhost:9001")
-	senderID, messageID := NewRandomID(), NewRandomID()
+	messageID := NewRandomID()
 	key, err := IDFromString("1234567890123456789012345678901234567890")
 	if err != nil {
 		t.Error("Could not encode key")
 		t.Fail()
 	}
 	value := []byte("somedata")
-	con := Contact{
-		NodeID: senderID,
-		Host:   net.IPv4(127, 0, 0, 1),
-		Port:   9001,
-	}
+	con, senderKey := newTestSender(net.IPv4(127, 0, 0, 1), 9001)
 	req := StoreRequest{
 		Sender: con,
 		MsgID:  messageID,
@@ -140,6 +131,7 @@ func TestStoreKeyWithFindValue(t *testing.T) {
 		Value:  value,
 	}
 	res := new(StoreResult)
+	signMessage(senderKey, &req)
 	err = kc.Store(req, res)
 	if err != nil {
 		t.Error("Failed to store key-value pair")
@@ -155,6 +147,7 @@ func TestStoreKeyWithFindValue(t *testing.T) {
 		MsgID:  messageID,
 		Key:    key,
 	}
+	signMessage(senderKey, &findRequest)
 	findResult := new(FindValueResult)
 	err = kc.FindValue(findRequest, findResult)
 	if err != nil {
@@ -186,7 +179,7 @@ func TestPingSelf(t *testing.T) {
 	//value := []byte("somedata")
 	selfHost := net.IPv4(127, 0, 0, 1)
 	selfPort := uint16(9002)
-	res := kc.kademlia.DoPing(selfHost, selfPort)
+	res := kc.kademlia.DoPing(context.Background(), selfHost, selfPort)
 	if strings.Contains(res, "ERR") {
 		t.Error("TestPingSelf: Failed to ping itself")
 		t.Fail()
@@ -204,7 +197,7 @@ func TestPingAnother(t *testing.T) {
 	kc2ID := kc2.kademlia.NodeID
 	kc2Host := net.IPv4(127, 0, 0, 1)
 	kc2Port := uint16(9004)
-	res := kc1.kademlia.DoPing(kc2Host, kc2Port)
+	res := kc1.kademlia.DoPing(context.Background(), kc2Host, kc2Port)
 	if strings.Contains(res, "ERR") {
 		t.Error("TestPingAnother: Failed to ping node 2 from node 1")
 		t.Fail()
@@ -241,7 +234,7 @@ func TestFindNode(t *testing.T) {
 	kc2Host := net.IPv4(127, 0, 0, 1)
 	kc2Port := uint16(9006)
 
-	res := kc1.kademlia.DoPing(kc2Host, kc2Port)
+	res := kc1.kademlia.DoPing(context.Background(), kc2Host, kc2Port)
 	if strings.Contains(res, "ERR") {
 		t.Error("TestPingAnother: Failed to ping node 2 from node 1")
 		t.Fail()
@@ -252,7 +245,6 @@ func TestFindNode(t *testing.T) {
 		t.Fail()
 	}
 
-	senderID := NewRandomID()
 	messageID := NewRandomID()
 	key, err := IDFromString("1234567890123456789012345678901234567890")
 	if err != nil {
@@ -260,11 +252,7 @@ func TestFindNode(t *testing.T) {
 		t.Fail()
 	}
 	value := []byte("somedata")
-	con := Contact{
-		NodeID: senderID,
-		Host:   net.IPv4(0x01, 0x02, 0x03, 0x04),
-		Port:   9006,
-	}
+	con, senderKey := newTestSender(net.IPv4(0x01, 0x02, 0x03, 0x04), 9006)
 	req := StoreRequest{
 		Sender: con,
 		MsgID:  messageID,
@@ -272,6 +260,7 @@ func TestFindNode(t *testing.T) {
 		Value:  value,
 	}
 	storeres := new(StoreResult)
+	signMessage(senderKey, &req)
 	err = kc1.Store(req, storeres)
 	if err != nil {
 		t.Error("Failed to store key-value pair")
@@ -291,7 +280,7 @@ func TestFindNode(t *testing.T) {
 	findCon.Host = kc1Host
 	findCon.Port = kc1Port
 
-	findres := kc2.kademlia.DoFindNode(findCon, key)
+	findres := kc2.kademlia.DoFindNode(context.Background(), findCon, key)
 	if strings.Contains(findres, "ERR") {
 		t.Error("DoFindNode failed")
 		t.Error("Returned " + findres)
@@ -311,13 +300,12 @@ func TestFindValue(t *testing.T) {
 	kc2Host := net.IPv4(127, 0, 0, 1)
 	kc2Port := uint16(9008)
 
-	res := kc1.kademlia.DoPing(kc2Host, kc2Port)
+	res := kc1.kademlia.DoPing(context.Background(), kc2Host, kc2Port)
 	if strings.Contains(res, "ERR") {
 		t.Error("TestPingAnother: Failed to ping node 2 from node 1")
 		t.Fail()
 	}
 
-	senderID := NewRandomID()
 	messageID := NewRandomID()
 	key, err := IDFromString("1234567890123456789012345678901234567890")
 	if err != nil {
@@ -325,11 +313,7 @@ func TestFindValue(t *testing.T) {
 		t.Fail()
 	}
 	value := []byte("somedata")
-	con := Contact{
-		NodeID: senderID,
-		Host:   net.IPv4(0x01, 0x02, 0x03, 0x04),
-		Port:   9008,
-	}
+	con, senderKey := newTestSender(net.IPv4(0x01, 0x02, 0x03, 0x04), 9008)
 	req := StoreRequest{
 		Sender: con,
 		MsgID:  messageID,
@@ -337,6 +321,7 @@ func TestFindValue(t *testing.T) {
 		Value:  value,
 	}
 	store_res := new(StoreResult)
+	signMessage(senderKey, &req)
 	err = kc1.Store(req, store_res)
 	if err != nil {
 		t.Error("Failed to store key-value pair")
@@ -347,7 +332,7 @@ func TestFindValue(t *testing.T) {
 	findCon.NodeID = kc1ID
 	findCon.Host = kc1Host
 	findCon.Port = kc1Port
-	find_val_res := kc2.kademlia.DoFindValue(findCon, key)
+	find_val_res := kc2.kademlia.DoFindValue(context.Background(), findCon, key)
 	if strings.Contains(find_val_res, "ERR") {
 		t.Error("DoFindNode failed")
 		t.Fail()
@@ -375,28 +360,62 @@ func TestIterativeFindNode(t *testing.T) {
 	// Ping each other, but iteratively
 	// After this, node2 is known to node1, and node3 is known to node2
 	// We're gonna look up node 3 from node 1 to see if the iterative lookup works.
-	res := kc1.kademlia.DoPing(kc2Host, kc2Port)
+	res := kc1.kademlia.DoPing(context.Background(), kc2Host, kc2Port)
 	if strings.Contains(res, "ERR") {
 		t.Error("TestIterativeFindNode: Ping failed")
 		t.Fail()
 	}
 
-	res = kc2.kademlia.DoPing(kc3Host, kc3Port)
+	res = kc2.kademlia.DoPing(context.Background(), kc3Host, kc3Port)
 	if strings.Contains(res, "ERR") {
 		t.Error("TestIterativeFindNode: Ping failed")
 		t.Fail()
 	}
 
-	testRes := kc1.kademlia.DoIterativeFindNode(kc3ID)
+	testRes := kc1.kademlia.DoIterativeFindNode(context.Background(), kc3ID)
 	if strings.Contains(testRes, "ERR") {
 		t.Error("TestIterativeFindNode: Node lookup failed")
 		t.Fail()
 	}
+
+	contacts := kc1.kademlia.DoIterativeFindNodeWrapper(context.Background(), kc3ID)
+	if len(contacts) == 0 || !contacts[0].NodeID.Equals(kc3ID) {
+		t.Error("TestIterativeFindNode: node 3 should be the closest contact found")
+		t.Fail()
+	}
 }
 
 func TestIterativeFindNodeWithALotOfNodes(t *testing.T) {
+	// Every node only knows node 0. A lookup from node 1 has to go through
+	// node 0 to find the last node.
+	nodes := make([]*Kademlia, 30)
+	for i := 0; i < len(nodes); i++ {
+		nodes[i] = NewKademlia("localhost:" + strconv.Itoa(9100+i))
+	}
+	for i := 1; i < len(nodes); i++ {
+		res := nodes[i].DoPing(context.Background(), net.IPv4(127, 0, 0, 1), uint16(9100))
+		if strings.Contains(res, "ERR") {
+			t.Error("TestIterativeFindNodeWithALotOfNodes: Ping failed")
+			t.Fail()
+		}
+	}
 
-
+	target := nodes[len(nodes)-1].NodeID
+	contacts := nodes[1].DoIterativeFindNodeWrapper(context.Background(), target)
+	if len(contacts) > k {
+		t.Error("TestIterativeFindNodeWithALotOfNodes: Returned more than k contacts")
+		t.Fail()
+	}
+	if len(contacts) == 0 || !contacts[0].NodeID.Equals(target) {
+		t.Error("TestIterativeFindNodeWithALotOfNodes: Did not find the target node")
+		t.Fail()
+	}
+	for i := 1; i < len(contacts); i++ {
+		if closerTo(target, contacts[i].NodeID, contacts[i-1].NodeID) {
+			t.Error("TestIterativeFindNodeWithALotOfNodes: Contacts are not sorted by distance")
+			t.Fail()
+		}
+	}
 }
 
 func TestIterativeFindNodeWithALotOfNodesWrapper(t *testing.T) {
@@ -409,39 +428,251 @@ func TestIterativeFindValue(t *testing.T) {
 	kc1 := new(KademliaCore)
 	kc2 := new(KademliaCore)
 	kc3 := new(KademliaCore)
-	kc1.kademlia = NewKademlia("localhost:9010")
-	kc2.kademlia = NewKademlia("localhost:9011")
-	kc3.kademlia = NewKademlia("localhost:9012")
+	kc1.kademlia = NewKademlia("localhost:9013")
+	kc2.kademlia = NewKademlia("localhost:9014")
+	kc3.kademlia = NewKademlia("localhost:9015")
 
-	//kc1ID := kc1.kademlia.NodeID
-	//kc2ID := kc2.kademlia.NodeID
-	kc3ID := kc3.kademlia.NodeID
-	//kc1Host := net.IPv4(127, 0, 0, 1)
 	kc2Host := net.IPv4(127, 0, 0, 1)
 	kc3Host := net.IPv4(127, 0, 0, 1)
-	//kc1Port := uint16(9010)
-	kc2Port := uint16(9011)
-	kc3Port := uint16(9012)
+	kc2Port := uint16(9014)
+	kc3Port := uint16(9015)
 
-	// Ping each other, but iteratively
-	// After this, node2 is known to node1, and node3 is known to node2
-	// We're gonna look up node 3 from node 1 to see if the iterative lookup works.
-	res := kc1.kademlia.DoPing(kc2Host, kc2Port)
+	// After this, node2 is known to node1, and node3 is known to node2.
+	// Only node 3 holds the value, so node 1 has to find it through node 2.
+	res := kc1.kademlia.DoPing(context.Background(), kc2Host, kc2Port)
 	if strings.Contains(res, "ERR") {
-		t.Error("TestIterativeFindNode: Ping failed")
+		t.Error("TestIterativeFindValue: Ping failed")
 		t.Fail()
 	}
 
-	res = kc2.kademlia.DoPing(kc3Host, kc3Port)
+	res = kc2.kademlia.DoPing(context.Background(), kc3Host, kc3Port)
 	if strings.Contains(res, "ERR") {
-		t.Error("TestIterativeFindNode: Ping failed")
+		t.Error("TestIterativeFindValue: Ping failed")
 		t.Fail()
 	}
 
-	testRes := kc1.kademlia.DoIterativeFindValue(kc3ID)
+	key := NewRandomID()
+	value := []byte("somedata")
+	req := StoreRequest{
+		Sender: kc2.kademlia.SelfContact,
+		MsgID:  NewRandomID(),
+		Key:    key,
+		Value:  value,
+	}
+	signMessage(kc2.kademlia.privateKey, &req)
+	err := kc3.Store(req, new(StoreResult))
+	if err != nil {
+		t.Error("TestIterativeFindValue: Failed to store key-value pair")
+		t.Fail()
+	}
+
+	found, holder, err := kc1.kademlia.IterativeFindValue(context.Background(), key)
+	if err != nil || !bytes.Equal(found, value) {
+		t.Error("TestIterativeFindValue: Retrieved value incorrect")
+		t.Fail()
+	}
+	if !holder.NodeID.Equals(kc3.kademlia.NodeID) {
+		t.Error("TestIterativeFindValue: Value should have been served by node 3")
+		t.Fail()
+	}
+
+	// node 2 was asked and did not have the value, so it should cache it
+	if !bytes.Equal(kc2.kademlia.getRecord(key), value) {
+		t.Error("TestIterativeFindValue: Value was not cached on node 2")
+		t.Fail()
+	}
+
+	testRes := kc1.kademlia.DoIterativeFindValue(context.Background(), key)
 	if strings.Contains(testRes, "ERR") {
-		t.Error("TestIterativeFindNode: Node lookup failed")
+		t.Error("TestIterativeFindValue: Value lookup failed")
+		t.Fail()
+	}
+
+	_, _, err = kc1.kademlia.IterativeFindValue(context.Background(), NewRandomID())
+	if err == nil {
+		t.Error("TestIterativeFindValue: Found a value for a key nobody stored")
+		t.Fail()
+	}
+}
+
+func TestIterativeStore(t *testing.T) {
+	// Every node knows node 0, so a store from node 1 should reach all of
+	// the other nodes.
+	network := NewMemoryNetwork()
+	nodes := make([]*Kademlia, 10)
+	for i := 0; i < len(nodes); i++ {
+		nodes[i] = newMemoryNode(network, "")
+		defer nodes[i].Close()
+	}
+	for i := 1; i < len(nodes); i++ {
+		res := nodes[i].DoPing(context.Background(), nodes[0].SelfContact.Host, nodes[0].SelfContact.Port)
+		if strings.Contains(res, "ERR") {
+			t.Error("TestIterativeStore: Ping failed")
+			t.Fail()
+		}
+	}
+
+	key := NewRandomID()
+	value := []byte("somedata")
+	report, err := nodes[1].IterativeStore(context.Background(), key, value)
+	if err != nil {
+		t.Error("TestIterativeStore: Store failed")
+		t.FailNow()
+	}
+	if len(report.Stored) != len(nodes)-1 || len(report.Failed) != 0 {
+		t.Error("TestIterativeStore: Expected " + strconv.Itoa(len(nodes)-1) +
+			" acknowledgements, got " + strconv.Itoa(len(report.Stored)))
 		t.Fail()
 	}
+	for _, con := range report.Stored {
+		for _, node := range nodes {
+			if node.NodeID.Equals(con.NodeID) && !bytes.Equal(node.getRecord(key), value) {
+				t.Error("TestIterativeStore: Node reported as stored does not hold the value")
+				t.Fail()
+			}
+		}
+	}
 }
 
+func TestTypedClientAPI(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad1 := newMemoryNode(network, "")
+	kad2 := newMemoryNode(network, "")
+	kad3 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+	defer kad3.Close()
+
+	// node 2 also knows node 3, so it has someone other than node 1 to
+	// return from FIND_NODE
+	if _, err := kad3.Ping(context.Background(), kad2.SelfContact.Host, kad2.SelfContact.Port); err != nil {
+		t.Error("TestTypedClientAPI: Ping from node 3 failed")
+		t.FailNow()
+	}
+
+	con, err := kad1.Ping(context.Background(), kad2.SelfContact.Host, kad2.SelfContact.Port)
+	if err != nil || !con.NodeID.Equals(kad2.NodeID) {
+		t.Error("TestTypedClientAPI: Ping did not return node 2's contact")
+		t.FailNow()
+	}
+
+	key := NewRandomID()
+	value := []byte("somedata")
+	if err = kad1.Store(context.Background(), &con, key, value); err != nil {
+		t.Error("TestTypedClientAPI: Store failed")
+		t.Fail()
+	}
+	if local, err := kad2.LocalValue(key); err != nil || !bytes.Equal(local, value) {
+		t.Error("TestTypedClientAPI: Value not stored on node 2")
+		t.Fail()
+	}
+
+	found, _, err := kad1.FindValue(context.Background(), &con, key)
+	if err != nil || !bytes.Equal(found, value) {
+		t.Error("TestTypedClientAPI: FindValue returned the wrong value")
+		t.Fail()
+	}
+	found, nodes, err := kad1.FindValue(context.Background(), &con, NewRandomID())
+	if err != nil || found != nil || len(nodes) == 0 {
+		t.Error("TestTypedClientAPI: FindValue on a missing key should return contacts")
+		t.Fail()
+	}
+
+	nodes, err = kad1.FindNode(context.Background(), &con, kad1.NodeID)
+	if err != nil || len(nodes) != 1 || !nodes[0].NodeID.Equals(kad3.NodeID) {
+		t.Error("TestTypedClientAPI: FindNode should return only node 3")
+		t.Fail()
+	}
+
+	if _, err = kad1.LocalValue(NewRandomID()); err == nil {
+		t.Error("TestTypedClientAPI: LocalValue found a key that was never stored")
+		t.Fail()
+	}
+}
+
+func TestRPCErrorsAndEviction(t *testing.T) {
+	kad := NewKademlia("localhost:9018")
+
+	// nothing listens on port 9019
+	_, err := kad.Ping(context.Background(), net.IPv4(127, 0, 0, 1), uint16(9019))
+	rpcErr, ok := err.(*RPCError)
+	if !ok || rpcErr.Kind != ErrUnreachable {
+		t.Error("TestRPCErrorsAndEviction: Expected an unreachable RPCError")
+		t.Fail()
+	}
+
+	dead := Contact{
+		NodeID: NewRandomID(),
+		Host:   net.IPv4(127, 0, 0, 1),
+		Port:   9019,
+	}
+	kad.UpdateContactInKBucket(&dead)
+	for i := 0; i < maxFailures; i++ {
+		if _, err := kad.FindContact(dead.NodeID); err != nil {
+			t.Error("TestRPCErrorsAndEviction: Contact evicted too early")
+			t.Fail()
+		}
+		if _, err := kad.FindNode(context.Background(), &dead, NewRandomID()); err == nil {
+			t.Error("TestRPCErrorsAndEviction: FindNode to a dead contact succeeded")
+			t.Fail()
+		}
+	}
+	if _, err := kad.FindContact(dead.NodeID); err == nil {
+		t.Error("TestRPCErrorsAndEviction: Dead contact was not evicted")
+		t.Fail()
+	}
+}
+
+func TestContextDeadlines(t *testing.T) {
+	config := DefaultConfig()
+	config.RPCTimeout = 100 * time.Millisecond
+	kad := NewKademliaWithConfig("localhost:9024", config)
+
+	// a listener that never answers the RPC handshake
+	silent, err := net.Listen("tcp", "localhost:9025")
+	if err != nil {
+		t.Fatal("TestContextDeadlines: Could not listen:", err)
+	}
+	defer silent.Close()
+
+	start := time.Now()
+	_, err = kad.Ping(context.Background(), net.IPv4(127, 0, 0, 1), 9025)
+	rpcErr, ok := err.(*RPCError)
+	if !ok || rpcErr.Kind != ErrTimeout {
+		t.Error("TestContextDeadlines: Expected the per-RPC timeout to fire, got", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("TestContextDeadlines: Ping ignored the per-RPC timeout")
+	}
+
+	// the caller's deadline wins if it is shorter
+	kad.Config.RPCTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = kad.Ping(ctx, net.IPv4(127, 0, 0, 1), 9025)
+	rpcErr, ok = err.(*RPCError)
+	if !ok || rpcErr.Kind != ErrCanceled || !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("TestContextDeadlines: Expected the caller's deadline to fire, got", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("TestContextDeadlines: Ping ignored the context deadline")
+	}
+
+	// a cancelled lookup returns right away
+	silentContact := Contact{NodeID: NewRandomID(), Host: net.IPv4(127, 0, 0, 1), Port: 9025}
+	kad.UpdateContactInKBucket(&silentContact)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	_, err = kad.IterativeFindNode(ctx, NewRandomID())
+	if !errors.Is(err, context.Canceled) {
+		t.Error("TestContextDeadlines: Expected the lookup to be cancelled, got", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("TestContextDeadlines: Lookup did not stop when cancelled")
+	}
+}
@@ -2,27 +2,52 @@ package kademlia
 
 import (
 	"sync"
+	"time"
 )
 
 // KBucket struct
 type KBucket struct {
-	NodeID           ID
+	NodeID ID
+	// the bucket holds the IDs whose first Depth bits are those of Prefix;
+	// the remaining bits of Prefix are zero
+	Prefix           ID
+	Depth            int
 	ContactList      []Contact
 	ContactMutexLock sync.Mutex
+	// consecutive failed RPCs per contact
+	Failures map[ID]int
+	// when each contact was last heard from, and how long the last RPC to
+	// it took while it was in the bucket
+	LastSeen map[ID]time.Time
+	RTT      map[ID]time.Duration
+	// when a lookup last went through this bucket
+	LastLookup time.Time
+	// contacts seen while the bucket was full, freshest last
+	Replacements []Contact
+	// set while the least recently seen contact is being pinged
+	checkingHead bool
 }
 
+// How many contacts a bucket keeps in its replacement cache.
+const replacementCacheSize = k
+
 // KBucket error
 type KBucketFullError struct {
 	updated Contact
-	index   int
 	msg     string
 }
 
-// Initialize KBuckets, called 160 times when Kademlia is instantiated in kademlia.go
+// Initialize KBuckets, called when Kademlia is instantiated in kademlia.go
+// and whenever a bucket is split
 func (kb *KBucket) Initialize() {
 	kb.NodeID = NewRandomID()
 	// create slice for ContactList
 	kb.ContactList = make([]Contact, 0, k)
+	kb.Replacements = make([]Contact, 0, replacementCacheSize)
+	kb.Failures = make(map[ID]int)
+	kb.LastSeen = make(map[ID]time.Time)
+	kb.RTT = make(map[ID]time.Duration)
+	kb.LastLookup = time.Now()
 }
 
 // Remove the contact corresponding to a given ID from the KBucket
@@ -45,6 +70,7 @@ func (kb *KBucket) AddContact(contactList *[]Contact, newContact Contact) {
 	toAdd.NodeID = newContact.NodeID
 	toAdd.Host = newContact.Host
 	toAdd.Port = newContact.Port
+	toAdd.PublicKey = newContact.PublicKey
 	*contactList = append(*contactList, *toAdd)
 }
 
@@ -68,7 +94,10 @@ func (kb *KBucket) ContainsContact(cont Contact) (exists bool, index int) {
 // Update the KBucket to sort the nodes with most recently used in at the head of the KBucket
 func (kb *KBucket) Update(updated Contact) (err *KBucketFullError) {
 	// check whether the updated contact exists in the KBucket
-	exists, index := kb.ContainsContact(updated)
+	exists, _ := kb.ContainsContact(updated)
+	// the contact is alive, forget about earlier failures
+	delete(kb.Failures, updated.NodeID)
+	kb.LastSeen[updated.NodeID] = time.Now()
 	if exists {
 		// move Contact to the end of the KBucket
 		kb.MoveToTail(updated)
@@ -79,18 +108,18 @@ func (kb *KBucket) Update(updated Contact) (err *KBucketFullError) {
 		temp.NodeID = CopyID(updated.NodeID)
 		temp.Host = updated.Host
 		temp.Port = updated.Port
+		temp.PublicKey = updated.PublicKey
 
 		kb.ContactMutexLock.Lock()
 		kb.AddContact(&kb.ContactList, *temp)
 		kb.ContactMutexLock.Unlock()
+		kb.removeReplacement(updated.NodeID)
 	} else {
-		// ping first node in slice
-		// if it doesn't respond, removeContact(oldContact) and addContact(updated)
-		// else moveToTail(oldContact) and ignore updated
+		// the caller should ping the first contact, and replace it with
+		// one from the replacement cache if it doesn't respond
 		err := new(KBucketFullError)
 		err.msg = "KBucket is full, ping the first contact and check if it exists."
 		err.updated = updated
-		err.index = index
 		return err
 	}
 	return nil
@@ -110,3 +139,138 @@ func (kb *KBucket) MoveToTail(updated Contact) {
 	kb.AddContact(&kb.ContactList, updated)
 	kb.ContactMutexLock.Unlock()
 }
+
+// Counts a failed RPC to the contact with the given ID. Once it has failed
+// maxFailures times in a row it is removed, and true is returned.
+func (kb *KBucket) RecordFailure(targetID ID) bool {
+	exists, _ := kb.ContainsContact(Contact{NodeID: targetID})
+	if !exists {
+		return false
+	}
+	kb.Failures[targetID] += 1
+	if kb.Failures[targetID] < maxFailures {
+		return false
+	}
+	kb.forget(targetID)
+	kb.ContactMutexLock.Lock()
+	kb.RemoveContact(targetID)
+	kb.ContactMutexLock.Unlock()
+	kb.PromoteReplacement()
+	return true
+}
+
+// Remembers a contact that did not fit into the full bucket. A contact that
+// is already cached moves to the end; past replacementCacheSize the oldest
+// one is dropped.
+func (kb *KBucket) AddReplacement(cont Contact) {
+	kb.removeReplacement(cont.NodeID)
+	if len(kb.Replacements) == replacementCacheSize {
+		kb.forget(kb.Replacements[0].NodeID)
+		kb.Replacements = kb.Replacements[1:]
+	}
+	kb.AddContact(&kb.Replacements, cont)
+}
+
+// Drops what the bucket knows about a contact it no longer holds.
+func (kb *KBucket) forget(targetID ID) {
+	delete(kb.Failures, targetID)
+	delete(kb.LastSeen, targetID)
+	delete(kb.RTT, targetID)
+}
+
+func (kb *KBucket) removeReplacement(targetID ID) {
+	for i := range kb.Replacements {
+		if kb.Replacements[i].NodeID == targetID {
+			kb.Replacements = append(kb.Replacements[:i], kb.Replacements[i+1:]...)
+			return
+		}
+	}
+}
+
+// Moves the freshest contact from the replacement cache into the bucket if
+// there is room for it. Returns false if nothing was promoted.
+func (kb *KBucket) PromoteReplacement() bool {
+	if len(kb.Replacements) == 0 || len(kb.ContactList) >= k {
+		return false
+	}
+	last := len(kb.Replacements) - 1
+	promoted := kb.Replacements[last]
+	kb.Replacements = kb.Replacements[:last]
+	kb.ContactMutexLock.Lock()
+	kb.AddContact(&kb.ContactList, promoted)
+	kb.ContactMutexLock.Unlock()
+	return true
+}
+
+// Reports whether id falls into the range of the bucket.
+func (kb *KBucket) Covers(id ID) bool {
+	return kb.Prefix.Xor(id).PrefixLen() >= kb.Depth
+}
+
+// Returns a random ID in the range of the bucket.
+func (kb *KBucket) RandomID() ID {
+	return randomIDWithPrefix(kb.Prefix, kb.Depth)
+}
+
+// Returns a random ID whose first bits bits are those of prefix.
+func randomIDWithPrefix(prefix ID, bits int) ID {
+	id := NewRandomID()
+	return maskID(prefix, bits).Xor(id.Xor(maskID(id, bits)))
+}
+
+// Returns id with every bit after the first bits bits cleared.
+func maskID(id ID, bits int) (ret ID) {
+	for i := 0; i < IDBytes && 8*i < bits; i++ {
+		mask := uint8(0xff)
+		if rest := bits - 8*i; rest < 8 {
+			mask = ^(mask >> uint(rest))
+		}
+		ret[i] = id[i] & mask
+	}
+	return
+}
+
+// Splits the bucket into two covering either half of its range. Contacts,
+// replacements and what is known about them go to the half their ID falls
+// into, and both halves keep the order the contacts were seen in.
+func (kb *KBucket) Split() (low *KBucket, high *KBucket) {
+	low, high = new(KBucket), new(KBucket)
+	low.Initialize()
+	high.Initialize()
+	low.Prefix = kb.Prefix
+	high.Prefix = kb.Prefix
+	high.Prefix[kb.Depth/8] |= 0x80 >> uint(kb.Depth%8)
+	low.Depth = kb.Depth + 1
+	high.Depth = kb.Depth + 1
+	low.LastLookup = kb.LastLookup
+	high.LastLookup = kb.LastLookup
+
+	half := func(id ID) *KBucket {
+		if high.Covers(id) {
+			return high
+		}
+		return low
+	}
+	carry := func(h *KBucket, id ID) {
+		if n, ok := kb.Failures[id]; ok {
+			h.Failures[id] = n
+		}
+		if seen, ok := kb.LastSeen[id]; ok {
+			h.LastSeen[id] = seen
+		}
+		if rtt, ok := kb.RTT[id]; ok {
+			h.RTT[id] = rtt
+		}
+	}
+	for _, c := range kb.ContactList {
+		h := half(c.NodeID)
+		h.AddContact(&h.ContactList, c)
+		carry(h, c.NodeID)
+	}
+	for _, c := range kb.Replacements {
+		h := half(c.NodeID)
+		h.AddContact(&h.Replacements, c)
+		carry(h, c.NodeID)
+	}
+	return low, high
+}
@@ -0,0 +1,168 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// Adds contacts nobody is listening on next to kad's own ID until the bucket
+// for id no longer holds it, and returns that bucket. Being full does not
+// split it then. The contacts never land in it, so it keeps what it held.
+func splitOff(kad *Kademlia, id ID, port uint16) *KBucket {
+	shared := kad.NodeID.Xor(id).PrefixLen()
+	for {
+		bucket, _ := kad.FindKBucket(id)
+		if !bucket.Covers(kad.NodeID) {
+			return bucket
+		}
+		c := Contact{NodeID: randomIDWithPrefix(kad.NodeID, shared+1), Host: net.IPv4(127, 0, 0, 1), Port: port}
+		kad.UpdateContactInKBucket(&c)
+		port++
+	}
+}
+
+// Returns a bucket of kad for the half of the ID space it is not in.
+func farBucket(kad *Kademlia, port uint16) *KBucket {
+	far := kad.NodeID
+	far[0] ^= 0x80
+	return splitOff(kad, far, port)
+}
+
+// Fills bucket of kad with contacts nobody is listening on, after whatever
+// the bucket already holds.
+func fillBucket(kad *Kademlia, bucket *KBucket, port uint16) {
+	for {
+		kad.BucketMutexLock.Lock()
+		full := len(bucket.ContactList) == k
+		kad.BucketMutexLock.Unlock()
+		if full {
+			return
+		}
+		c := Contact{NodeID: bucket.RandomID(), Host: net.IPv4(127, 0, 0, 1), Port: port}
+		kad.UpdateContactInKBucket(&c)
+		port++
+	}
+}
+
+// Waits for the head check of bucket to finish.
+func waitForHeadCheck(t *testing.T, kad *Kademlia, bucket *KBucket) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		kad.BucketMutexLock.Lock()
+		checking := bucket.checkingHead
+		kad.BucketMutexLock.Unlock()
+		if !checking {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("waitForHeadCheck: Head check never finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplacementCache(t *testing.T) {
+	kad := NewKademlia("localhost:9032")
+	defer kad.Close()
+	bucket := farBucket(kad, 11200)
+
+	cache := new(KBucket)
+	cache.Initialize()
+	for i := 0; i < replacementCacheSize+5; i++ {
+		cache.AddReplacement(Contact{NodeID: bucket.RandomID(), Host: net.IPv4(127, 0, 0, 1), Port: uint16(10500 + i)})
+	}
+	if len(cache.Replacements) != replacementCacheSize {
+		t.Error("TestReplacementCache: Replacement cache is not bounded")
+	}
+	first := cache.Replacements[0]
+	cache.AddReplacement(first)
+	if !cache.Replacements[len(cache.Replacements)-1].NodeID.Equals(first.NodeID) {
+		t.Error("TestReplacementCache: Contact seen again was not moved to the end")
+	}
+
+	fillBucket(kad, bucket, 10600)
+	head := bucket.ContactList[0]
+	candidate := Contact{NodeID: bucket.RandomID(), Host: net.IPv4(127, 0, 0, 1), Port: 10700}
+	kad.UpdateContactInKBucket(&candidate)
+	waitForHeadCheck(t, kad, bucket)
+
+	kad.BucketMutexLock.Lock()
+	defer kad.BucketMutexLock.Unlock()
+	if exists, _ := bucket.ContainsContact(head); exists {
+		t.Error("TestReplacementCache: Dead head was not evicted")
+	}
+	if exists, _ := bucket.ContainsContact(candidate); !exists {
+		t.Error("TestReplacementCache: Candidate was not promoted")
+	}
+	if len(bucket.Replacements) != 0 {
+		t.Error("TestReplacementCache: Promoted candidate is still cached")
+	}
+}
+
+func TestAliveHeadIsKept(t *testing.T) {
+	kad1 := NewKademlia("localhost:9033")
+	kad2 := NewKademlia("localhost:9034")
+	defer kad1.Close()
+	defer kad2.Close()
+
+	pong, err := kad1.Ping(context.Background(), net.IPv4(127, 0, 0, 1), 9034)
+	if err != nil {
+		t.Fatal("TestAliveHeadIsKept: Ping failed:", err)
+	}
+	bucket := splitOff(kad1, kad2.NodeID, 11300)
+	fillBucket(kad1, bucket, 10800)
+	if !bucket.ContactList[0].NodeID.Equals(pong.NodeID) {
+		t.Fatal("TestAliveHeadIsKept: Node 2 is not the head of its bucket")
+	}
+
+	candidate := Contact{NodeID: bucket.RandomID(), Host: net.IPv4(127, 0, 0, 1), Port: 10900}
+	kad1.UpdateContactInKBucket(&candidate)
+	waitForHeadCheck(t, kad1, bucket)
+
+	kad1.BucketMutexLock.Lock()
+	defer kad1.BucketMutexLock.Unlock()
+	if exists, _ := bucket.ContainsContact(pong); !exists {
+		t.Error("TestAliveHeadIsKept: Live head was evicted")
+	}
+	if exists, _ := bucket.ContainsContact(candidate); exists {
+		t.Error("TestAliveHeadIsKept: Candidate replaced a live head")
+	}
+	if len(bucket.Replacements) != 1 || !bucket.Replacements[0].NodeID.Equals(candidate.NodeID) {
+		t.Error("TestAliveHeadIsKept: Candidate is not in the replacement cache")
+	}
+}
+
+func TestFullBucketDoesNotBlock(t *testing.T) {
+	// a listener that accepts connections but never answers
+	silent, err := net.Listen("tcp", "localhost:9035")
+	if err != nil {
+		t.Fatal("TestFullBucketDoesNotBlock: Listen failed:", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			if _, err := silent.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	config := DefaultConfig()
+	config.RPCTimeout = 300 * time.Millisecond
+	kad := NewKademliaWithConfig("localhost:9036", config)
+	defer kad.Close()
+	bucket := farBucket(kad, 11400)
+	head := Contact{NodeID: bucket.RandomID(), Host: net.IPv4(127, 0, 0, 1), Port: 9035}
+	kad.UpdateContactInKBucket(&head)
+	fillBucket(kad, bucket, 11000)
+
+	candidate := Contact{NodeID: bucket.RandomID(), Host: net.IPv4(127, 0, 0, 1), Port: 11100}
+	start := time.Now()
+	kad.UpdateContactInKBucket(&candidate)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("TestFullBucketDoesNotBlock: Update waited on the head ping")
+	}
+	waitForHeadCheck(t, kad, bucket)
+}
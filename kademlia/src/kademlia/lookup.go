@@ -0,0 +1,286 @@
+package kademlia
+
+// Contains the iterative lookup engine shared by the DoIterative* functions.
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A contact on the shortlist along with its lookup state.
+type shortlistEntry struct {
+	contact   Contact
+	queried   bool
+	responded bool
+}
+
+// Contacts known to a lookup, ordered by XOR distance to the target. Nodes
+// that fail to answer are dropped and never re-added.
+type shortlist struct {
+	target  ID
+	entries []*shortlistEntry
+	seen    map[ID]bool
+	// shared with the other paths of a disjoint lookup, if any
+	claims *pathClaims
+	// rounds of queries made so far, and the contacts they went to
+	rounds  int
+	queried []Contact
+}
+
+// Nodes taken by the paths of a disjoint lookup. Each node belongs to the
+// first path that learns of it and is never queried by another.
+type pathClaims struct {
+	mutex   sync.Mutex
+	claimed map[ID]bool
+}
+
+// Returns false if another path has the node already.
+func (p *pathClaims) claim(id ID) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.claimed[id] {
+		return false
+	}
+	p.claimed[id] = true
+	return true
+}
+
+func newShortlist(target ID, self ID) *shortlist {
+	s := new(shortlist)
+	s.target = target
+	s.entries = make([]*shortlistEntry, 0, k)
+	s.seen = make(map[ID]bool)
+	// never look ourselves up
+	s.seen[self] = true
+	return s
+}
+
+// Returns true if a is strictly closer to target than b.
+func closerTo(target ID, a ID, b ID) bool {
+	return a.Xor(target).Less(b.Xor(target))
+}
+
+// Adds a contact in distance order. Returns false if it was seen before.
+func (s *shortlist) add(c Contact) bool {
+	if s.seen[c.NodeID] || c.Host == nil {
+		return false
+	}
+	s.seen[c.NodeID] = true
+	if s.claims != nil && !s.claims.claim(c.NodeID) {
+		return false
+	}
+
+	i := len(s.entries)
+	for i > 0 && closerTo(s.target, c.NodeID, s.entries[i-1].contact.NodeID) {
+		i--
+	}
+	s.entries = append(s.entries, nil)
+	copy(s.entries[i+1:], s.entries[i:])
+	s.entries[i] = &shortlistEntry{contact: c}
+	return true
+}
+
+func (s *shortlist) remove(id ID) {
+	for i, e := range s.entries {
+		if e.contact.NodeID.Equals(id) {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *shortlist) find(id ID) *shortlistEntry {
+	for _, e := range s.entries {
+		if e.contact.NodeID.Equals(id) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Picks up to n contacts among the k closest that have not been queried yet
+// and marks them as queried.
+func (s *shortlist) next(n int) []Contact {
+	batch := make([]Contact, 0, n)
+	for i := 0; i < len(s.entries) && i < k && len(batch) < n; i++ {
+		e := s.entries[i]
+		if !e.queried {
+			e.queried = true
+			batch = append(batch, e.contact)
+			s.queried = append(s.queried, e.contact)
+		}
+	}
+	return batch
+}
+
+// Returns the k closest contacts that answered.
+func (s *shortlist) live() []Contact {
+	res := make([]Contact, 0, k)
+	for _, e := range s.entries {
+		if len(res) == k {
+			break
+		}
+		if e.responded {
+			res = append(res, e.contact)
+		}
+	}
+	return res
+}
+
+// Runs an iterative lookup toward target. query is called for every contact
+// taken off the shortlist, at most alpha at a time. The lookup stops early
+// if a query returns a value, in which case that reply is returned as well.
+// If ctx is done before the lookup finishes, ctx.Err() is returned.
+//
+// With Config.DisjointPaths above 1, that many lookups run side by side,
+// each starting from its share of the routing table and never querying a
+// node another one has, so a bad node can only mislead the path it is on.
+// The returned shortlist merges the contacts of every path.
+func (k *Kademlia) iterativeLookup(ctx context.Context, target ID, query func(context.Context, Contact) ValueWrapper) (*shortlist, *ValueWrapper, error) {
+	start := time.Now()
+	k.touchBucket(target)
+	initial := k.FindCloseContacts(target, k.NodeID)
+
+	// queries still in flight are abandoned once the lookup returns
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d := k.Config.DisjointPaths
+	if d <= 1 {
+		list := newShortlist(target, k.NodeID)
+		for _, con := range initial {
+			list.add(con)
+		}
+		found, err := runLookup(ctx, list, query)
+		k.lookupDone(target, start, []*shortlist{list}, found, err)
+		return list, found, err
+	}
+
+	claims := &pathClaims{claimed: make(map[ID]bool)}
+	claims.claim(k.NodeID)
+	paths := make([]*shortlist, d)
+	for i := range paths {
+		paths[i] = newShortlist(target, k.NodeID)
+		paths[i].claims = claims
+	}
+	for i, con := range initial {
+		paths[i%d].add(con)
+	}
+
+	type pathResult struct {
+		found *ValueWrapper
+		err   error
+	}
+	results := make(chan pathResult, d)
+	for _, list := range paths {
+		go func(list *shortlist) {
+			found, err := runLookup(ctx, list, query)
+			results <- pathResult{found, err}
+		}(list)
+	}
+	var found *ValueWrapper
+	var err error
+	for range paths {
+		res := <-results
+		if res.found != nil && found == nil {
+			// one path finding the value is enough, stop the others
+			found = res.found
+			cancel()
+		} else if res.err != nil && err == nil {
+			err = res.err
+		}
+	}
+	if found != nil {
+		err = nil
+	}
+	k.lookupDone(target, start, paths, found, err)
+	return mergeShortlists(target, k.NodeID, paths), found, err
+}
+
+// Records a finished lookup in the metrics and among the recent lookups.
+func (k *Kademlia) lookupDone(target ID, start time.Time, paths []*shortlist, found *ValueWrapper, err error) {
+	status := LookupStatus{
+		Target:   target.AsString(),
+		Started:  start,
+		Duration: time.Since(start),
+		Paths:    len(paths),
+		Found:    found != nil,
+		Queried:  make([]string, 0),
+	}
+	for _, list := range paths {
+		// the paths ran side by side, so the lookup was as deep as the
+		// deepest one
+		if list.rounds > status.Hops {
+			status.Hops = list.rounds
+		}
+		for _, con := range list.queried {
+			status.Queried = append(status.Queried, con.NodeID.AsString())
+		}
+	}
+	if err != nil {
+		status.Err = err.Error()
+	}
+	k.metrics.lookupDone(status)
+}
+
+// Merges the shortlists of a disjoint lookup into one.
+func mergeShortlists(target ID, self ID, paths []*shortlist) *shortlist {
+	list := newShortlist(target, self)
+	for _, path := range paths {
+		for _, e := range path.entries {
+			if list.add(e.contact) {
+				list.find(e.contact.NodeID).responded = e.responded
+			}
+		}
+	}
+	return list
+}
+
+// Runs the lookup on a single shortlist until every one of its k closest
+// contacts has answered or been dropped.
+func runLookup(ctx context.Context, list *shortlist, query func(context.Context, Contact) ValueWrapper) (*ValueWrapper, error) {
+	// Each round queries the alpha closest nodes not yet asked. When a round
+	// fails to turn up anything closer than the closest node seen, the
+	// remaining unqueried nodes among the k closest are still asked (alpha
+	// at a time), so the lookup only ends once every one of the k closest
+	// has answered or been dropped.
+	results := make(chan ValueWrapper, alpha)
+	for {
+		batch := list.next(alpha)
+		if len(batch) == 0 {
+			break
+		}
+		list.rounds++
+
+		for _, con := range batch {
+			go func(con Contact) {
+				results <- query(ctx, con)
+			}(con)
+		}
+
+		for range batch {
+			var res ValueWrapper
+			select {
+			case res = <-results:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			entry := list.find(res.Contact.NodeID)
+			if res.Error != nil {
+				list.remove(res.Contact.NodeID)
+				continue
+			}
+			if entry != nil {
+				entry.responded = true
+			}
+			if res.Value != nil {
+				return &res, nil
+			}
+			for _, con := range res.KnownContacts {
+				list.add(con)
+			}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,107 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+)
+
+// Returns target with the given byte flipped by mask.
+func nearID(target ID, i int, mask byte) ID {
+	id := CopyID(target)
+	id[i] ^= mask
+	return id
+}
+
+func TestDisjointLookupSurvivesBadNode(t *testing.T) {
+	kad := newMemoryNode(NewMemoryNetwork(), "")
+	defer kad.Close()
+	target := NewRandomID()
+	host := net.IPv4(192, 0, 2, 1)
+
+	// the node holding the value is only known to the two honest nodes; the
+	// bad node answers with sybils closer to the target than the holder,
+	// which answer with each other
+	bad := Contact{NodeID: nearID(target, 1, 0x01), Host: host, Port: 1}
+	honest := []Contact{
+		{NodeID: nearID(target, 0, 0x80), Host: host, Port: 2},
+		{NodeID: nearID(target, 0, 0x40), Host: host, Port: 3},
+	}
+	holder := Contact{NodeID: nearID(target, 10, 0x01), Host: host, Port: 4}
+	var sybils []Contact
+	isSybil := make(map[ID]bool)
+	for i := 0; i < 2*k; i++ {
+		id := nearID(target, 19, byte(i+1))
+		sybils = append(sybils, Contact{NodeID: id, Host: host, Port: uint16(100 + i)})
+		isSybil[id] = true
+	}
+	kad.UpdateContactInKBucket(&bad)
+	for i := range honest {
+		kad.UpdateContactInKBucket(&honest[i])
+	}
+
+	value := []byte("found")
+	query := func(ctx context.Context, con Contact) ValueWrapper {
+		switch {
+		case con.NodeID.Equals(bad.NodeID) || isSybil[con.NodeID]:
+			return ValueWrapper{Contact: con, KnownContacts: sybils}
+		case con.NodeID.Equals(holder.NodeID):
+			return ValueWrapper{Contact: con, Value: value}
+		}
+		return ValueWrapper{Contact: con, KnownContacts: []Contact{holder}}
+	}
+
+	_, found, err := kad.iterativeLookup(context.Background(), target, query)
+	if err != nil || found != nil {
+		t.Fatal("TestDisjointLookupSurvivesBadNode: Single path was expected to be misled:", err)
+	}
+
+	kad.Config.DisjointPaths = 3
+	list, found, err := kad.iterativeLookup(context.Background(), target, query)
+	if err != nil || found == nil || !bytes.Equal(found.Value, value) {
+		t.Fatal("TestDisjointLookupSurvivesBadNode: Disjoint paths did not find the value:", err)
+	}
+	// the paths never shared a node
+	seen := make(map[ID]bool)
+	for _, e := range list.entries {
+		if seen[e.contact.NodeID] {
+			t.Error("TestDisjointLookupSurvivesBadNode: Merged shortlist has duplicates")
+		}
+		seen[e.contact.NodeID] = true
+	}
+}
+
+func TestDisjointPathsOnNetwork(t *testing.T) {
+	network := NewMemoryNetwork()
+	config := DefaultConfig()
+	config.DisjointPaths = 3
+	nodes := make([]*Kademlia, 100)
+	for i := range nodes {
+		config.Transport = network.Transport()
+		nodes[i] = NewKademliaWithConfig("", config)
+		defer nodes[i].Close()
+	}
+	joinNetwork(t, nodes)
+	ctx := context.Background()
+
+	key := NewRandomID()
+	contacts, err := nodes[10].IterativeFindNode(ctx, key)
+	if err != nil || len(contacts) != k {
+		t.Fatal("TestDisjointPathsOnNetwork: IterativeFindNode failed:", err)
+	}
+	for i := 1; i < len(contacts); i++ {
+		if !closerTo(key, contacts[i-1].NodeID, contacts[i].NodeID) {
+			t.Fatal("TestDisjointPathsOnNetwork: Merged contacts are not in distance order")
+		}
+	}
+
+	report, err := nodes[20].IterativeStore(ctx, key, []byte("disjoint"))
+	if err != nil || len(report.Stored) != k {
+		t.Fatal("TestDisjointPathsOnNetwork: IterativeStore failed:", err)
+	}
+	value, _, err := nodes[30].IterativeFindValue(ctx, key)
+	if err != nil || !bytes.Equal(value, []byte("disjoint")) {
+		t.Error("TestDisjointPathsOnNetwork: IterativeFindValue failed:", err)
+	}
+}
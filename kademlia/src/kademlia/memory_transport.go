@@ -0,0 +1,217 @@
+package kademlia
+
+// Contains a Transport that connects nodes in the same process through
+// channels, for simulating large networks without sockets.
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"net"
+	"net/rpc"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// A simulated network. Transports created from the same network can reach
+// each other; nothing else can.
+type MemoryNetwork struct {
+	mutex sync.Mutex
+	nodes map[string]*memoryNode
+	// used to hand out addresses to nodes listening on ""
+	next uint32
+}
+
+type memoryNode struct {
+	core   *KademliaCore
+	inbox  chan *memoryCall
+	closed chan bool
+}
+
+// An RPC in flight. Arguments and replies are gob encoded on the way, so
+// neither side can see the other's memory, as over a real network.
+type memoryCall struct {
+	method string
+	args   []byte
+	reply  []byte
+	err    error
+	done   chan bool
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	n := new(MemoryNetwork)
+	n.nodes = make(map[string]*memoryNode)
+	return n
+}
+
+// Returns a new transport attached to the network.
+func (n *MemoryNetwork) Transport() *MemoryTransport {
+	return &MemoryTransport{network: n}
+}
+
+func (n *MemoryNetwork) lookup(address string) *memoryNode {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.nodes[address]
+}
+
+// Number of nodes listening on the network.
+func (n *MemoryNetwork) Size() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return len(n.nodes)
+}
+
+// Transport on a MemoryNetwork.
+type MemoryTransport struct {
+	network *MemoryNetwork
+	address string
+	node    *memoryNode
+}
+
+// Listens at laddr, which must be an IP address and port. With an empty
+// laddr the network picks an unused address in 10.0.0.0/8.
+func (t *MemoryTransport) Listen(laddr string) (net.IP, uint16, error) {
+	n := t.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if t.node != nil {
+		return nil, 0, errors.New("transport is already listening")
+	}
+
+	var host net.IP
+	var port uint16
+	if laddr == "" {
+		for {
+			n.next++
+			host = net.IPv4(10, byte(n.next>>16), byte(n.next>>8), byte(n.next))
+			port = 7890
+			if n.nodes[memoryAddress(host, port)] == nil {
+				break
+			}
+		}
+	} else {
+		hostname, portstr, err := net.SplitHostPort(laddr)
+		if err != nil {
+			return nil, 0, err
+		}
+		host = net.ParseIP(hostname)
+		p, err := strconv.ParseUint(portstr, 10, 16)
+		if host == nil || err != nil || p == 0 {
+			return nil, 0, errors.New("not an IP address and port: " + laddr)
+		}
+		port = uint16(p)
+	}
+	address := memoryAddress(host, port)
+	if n.nodes[address] != nil {
+		return nil, 0, errors.New("address already in use: " + address)
+	}
+
+	// calls queue up in the inbox until Serve is called
+	node := &memoryNode{nil, make(chan *memoryCall), make(chan bool)}
+	n.nodes[address] = node
+	t.address = address
+	t.node = node
+	return host, port, nil
+}
+
+func (t *MemoryTransport) Serve(core *KademliaCore) {
+	t.node.core = core
+	go t.node.serve()
+}
+
+func memoryAddress(host net.IP, port uint16) string {
+	return net.JoinHostPort(host.String(), strconv.Itoa(int(port)))
+}
+
+// Handles calls until the node is closed, each in its own goroutine.
+func (node *memoryNode) serve() {
+	for {
+		select {
+		case call := <-node.inbox:
+			go node.dispatch(call)
+		case <-node.closed:
+			return
+		}
+	}
+}
+
+// Calls the KademliaCore method named by call, the way net/rpc would.
+func (node *memoryNode) dispatch(call *memoryCall) {
+	defer close(call.done)
+	name := strings.TrimPrefix(call.method, "KademliaCore.")
+	m := reflect.ValueOf(node.core).MethodByName(name)
+	if !m.IsValid() || m.Type().NumIn() != 2 || m.Type().NumOut() != 1 ||
+		m.Type().In(1).Kind() != reflect.Ptr || m.Type().Out(0) != errorType {
+		call.err = errors.New("rpc: can't find method " + call.method)
+		return
+	}
+
+	args := reflect.New(m.Type().In(0))
+	if err := gob.NewDecoder(bytes.NewReader(call.args)).DecodeValue(args); err != nil {
+		call.err = err
+		return
+	}
+	reply := reflect.New(m.Type().In(1).Elem())
+	out := m.Call([]reflect.Value{args.Elem(), reply})
+	if err, _ := out[0].Interface().(error); err != nil {
+		call.err = rpc.ServerError(err.Error())
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).EncodeValue(reply); err != nil {
+		call.err = rpc.ServerError(err.Error())
+		return
+	}
+	call.reply = buf.Bytes()
+}
+
+func (t *MemoryTransport) Call(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) error {
+	address := memoryAddress(contact.Host, contact.Port)
+	node := t.network.lookup(address)
+	if node == nil {
+		return errors.New("connection refused: " + address)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		return err
+	}
+	call := &memoryCall{method: method, args: buf.Bytes(), done: make(chan bool)}
+	select {
+	case node.inbox <- call:
+	case <-node.closed:
+		return errors.New("connection refused: " + address)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if call.err != nil {
+		return call.err
+	}
+	return gob.NewDecoder(bytes.NewReader(call.reply)).Decode(reply)
+}
+
+// Takes the node off the network. Calls to it fail from then on.
+func (t *MemoryTransport) Close() error {
+	n := t.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if t.node == nil {
+		return nil
+	}
+	delete(n.nodes, t.address)
+	close(t.node.closed)
+	t.node = nil
+	return nil
+}
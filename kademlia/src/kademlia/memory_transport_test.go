@@ -0,0 +1,105 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func newMemoryNode(network *MemoryNetwork, laddr string) *Kademlia {
+	config := DefaultConfig()
+	config.Transport = network.Transport()
+	return NewKademliaWithConfig(laddr, config)
+}
+
+// Bootstraps every node with the first one as its seed.
+func joinNetwork(t *testing.T, nodes []*Kademlia) {
+	ctx := context.Background()
+	seed := hostPort(nodes[0].SelfContact.Host, nodes[0].SelfContact.Port)
+	for _, node := range nodes[1:] {
+		if _, err := node.Bootstrap(ctx, seed); err != nil {
+			t.Fatal("joinNetwork: Bootstrap failed:", err)
+		}
+	}
+}
+
+func TestMemoryTransport(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad1 := newMemoryNode(network, "")
+	kad2 := newMemoryNode(network, "192.0.2.1:4000")
+	defer kad1.Close()
+	ctx := context.Background()
+
+	if kad2.SelfContact.Port != 4000 || !kad2.SelfContact.Host.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Error("TestMemoryTransport: Node did not get the address it asked for")
+	}
+	if kad1.SelfContact.Host.Equal(kad2.SelfContact.Host) {
+		t.Error("TestMemoryTransport: Nodes share an address")
+	}
+	if network.Size() != 2 {
+		t.Error("TestMemoryTransport: Network has the wrong size")
+	}
+
+	pong, err := kad1.Ping(ctx, kad2.SelfContact.Host, kad2.SelfContact.Port)
+	if err != nil || !pong.NodeID.Equals(kad2.NodeID) {
+		t.Fatal("TestMemoryTransport: Ping failed:", err)
+	}
+	key := NewRandomID()
+	value := []byte("in memory")
+	if err := kad1.Store(ctx, &kad2.SelfContact, key, value); err != nil {
+		t.Fatal("TestMemoryTransport: Store failed:", err)
+	}
+	// the stored value must not share memory with the sender's
+	value[0] = 'X'
+	if got, _ := kad2.LocalValue(key); !bytes.Equal(got, []byte("in memory")) {
+		t.Error("TestMemoryTransport: Stored value was not copied")
+	}
+
+	kad2.Close()
+	var rpcErr *RPCError
+	_, err = kad1.Ping(ctx, kad2.SelfContact.Host, kad2.SelfContact.Port)
+	if !errors.As(err, &rpcErr) || rpcErr.Kind != ErrUnreachable {
+		t.Error("TestMemoryTransport: Closed node is not unreachable:", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = kad1.Ping(canceled, kad1.SelfContact.Host, kad1.SelfContact.Port)
+	if !errors.As(err, &rpcErr) || rpcErr.Kind != ErrCanceled {
+		t.Error("TestMemoryTransport: Canceled call did not fail as canceled:", err)
+	}
+}
+
+// Joining thousands of nodes takes minutes, so by default the network has
+// 200. Set KADEMLIA_LARGE_NETWORK to run it with 2000.
+func TestMemoryNetworkWithThousandsOfNodes(t *testing.T) {
+	count := 200
+	if os.Getenv("KADEMLIA_LARGE_NETWORK") != "" {
+		count = 2000
+	}
+	network := NewMemoryNetwork()
+	nodes := make([]*Kademlia, count)
+	for i := range nodes {
+		nodes[i] = newMemoryNode(network, "")
+		defer nodes[i].Close()
+	}
+
+	joinNetwork(t, nodes)
+	ctx := context.Background()
+
+	start := time.Now()
+	key := NewRandomID()
+	report, err := nodes[count/3].IterativeStore(ctx, key, []byte("everywhere"))
+	if err != nil || len(report.Stored) != k {
+		t.Fatal("TestMemoryNetworkWithThousandsOfNodes: IterativeStore failed:", err)
+	}
+	value, _, err := nodes[2*count/3].IterativeFindValue(ctx, key)
+	if err != nil || !bytes.Equal(value, []byte("everywhere")) {
+		t.Error("TestMemoryNetworkWithThousandsOfNodes: IterativeFindValue failed:", err)
+	}
+	t.Log("store and lookup took", time.Since(start))
+}
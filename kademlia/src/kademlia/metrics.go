@@ -0,0 +1,295 @@
+package kademlia
+
+// Contains the counters and histograms a node keeps about itself, and the
+// handler that serves them at /metrics in the Prometheus text format.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency buckets, in seconds.
+var latencyBounds = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Upper bounds of the buckets for the number of hops a lookup takes.
+var hopBounds = []float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20}
+
+// A cumulative histogram, as Prometheus has it.
+type histogram struct {
+	bounds []float64
+	// counts[i] is the number of observations at most bounds[i]
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) clone() *histogram {
+	c := *h
+	c.counts = append([]uint64(nil), h.counts...)
+	return &c
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Writes the _bucket, _sum and _count series of the histogram. labels are
+// put in front of the le label, and may be empty.
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// Outbound RPCs that failed, by method and RPCErrorKind.
+type rpcErrorKey struct {
+	method string
+	kind   string
+}
+
+// What a node has counted since it started.
+type nodeMetrics struct {
+	mutex         sync.Mutex
+	calls         map[string]uint64
+	errors        map[rpcErrorKey]uint64
+	rpcLatency    map[string]*histogram
+	lookupLatency *histogram
+	lookupHops    *histogram
+	// inbound RPCs handled by KademliaCore, and those that failed
+	served       map[string]uint64
+	servedErrors map[string]uint64
+	// the last recentLookups lookups, oldest first
+	lookups []LookupStatus
+}
+
+// How many finished lookups are kept for the status page.
+const recentLookups = 20
+
+func newNodeMetrics() *nodeMetrics {
+	m := new(nodeMetrics)
+	m.calls = make(map[string]uint64)
+	m.errors = make(map[rpcErrorKey]uint64)
+	m.rpcLatency = make(map[string]*histogram)
+	m.lookupLatency = newHistogram(latencyBounds)
+	m.lookupHops = newHistogram(hopBounds)
+	m.served = make(map[string]uint64)
+	m.servedErrors = make(map[string]uint64)
+	return m
+}
+
+// Copies the counters, so that they can be written out without holding the
+// lock.
+func (m *nodeMetrics) snapshot() *nodeMetrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	c := newNodeMetrics()
+	for method, n := range m.calls {
+		c.calls[method] = n
+	}
+	for key, n := range m.errors {
+		c.errors[key] = n
+	}
+	for method, h := range m.rpcLatency {
+		c.rpcLatency[method] = h.clone()
+	}
+	c.lookupLatency = m.lookupLatency.clone()
+	c.lookupHops = m.lookupHops.clone()
+	for method, n := range m.served {
+		c.served[method] = n
+	}
+	for method, n := range m.servedErrors {
+		c.servedErrors[method] = n
+	}
+	return c
+}
+
+// Counts an outbound RPC that took elapsed and ended with err.
+func (m *nodeMetrics) rpcDone(method string, elapsed time.Duration, err error) {
+	method = strings.TrimPrefix(method, "KademliaCore.")
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.calls[method]++
+	if err != nil {
+		kind := "local"
+		var rpcErr *RPCError
+		if errors.As(err, &rpcErr) {
+			kind = rpcErr.Kind.String()
+		}
+		m.errors[rpcErrorKey{method, kind}]++
+	}
+	latency := m.rpcLatency[method]
+	if latency == nil {
+		latency = newHistogram(latencyBounds)
+		m.rpcLatency[method] = latency
+	}
+	latency.observe(elapsed.Seconds())
+}
+
+// Counts an inbound RPC handled by KademliaCore that ended with err.
+func (m *nodeMetrics) rpcServed(method string, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.served[method]++
+	if err != nil {
+		m.servedErrors[method]++
+	}
+}
+
+// Counts a finished lookup and keeps it among the recent ones.
+func (m *nodeMetrics) lookupDone(status LookupStatus) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lookupLatency.observe(status.Duration.Seconds())
+	m.lookupHops.observe(float64(status.Hops))
+	if len(m.lookups) == recentLookups {
+		m.lookups = m.lookups[1:]
+	}
+	m.lookups = append(m.lookups, status)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Writes the metrics of the node to w in the Prometheus text format. The
+// routing table, the store and the VDOs are looked at as they are now. All
+// of it is copied before anything is written, so a slow w holds up nothing.
+func (k *Kademlia) WriteMetrics(w io.Writer) {
+	m := k.metrics.snapshot()
+
+	type bucketSize struct {
+		depth    int
+		contacts int
+	}
+	k.BucketMutexLock.Lock()
+	buckets := make([]bucketSize, 0, len(k.BucketList))
+	for _, bucket := range k.BucketList {
+		buckets = append(buckets, bucketSize{bucket.Depth, len(bucket.ContactList)})
+	}
+	k.BucketMutexLock.Unlock()
+
+	keys, size := 0, 0
+	k.Table.Iterate(func(key ID, rec Record) bool {
+		keys++
+		size += len(rec.Value)
+		return true
+	})
+
+	k.vdoMutexLock.Lock()
+	vdos := len(k.Vdos)
+	k.vdoMutexLock.Unlock()
+
+	fmt.Fprintln(w, "# HELP kademlia_rpc_calls_total Outbound RPCs made, by method.")
+	fmt.Fprintln(w, "# TYPE kademlia_rpc_calls_total counter")
+	for _, method := range sortedKeys(m.calls) {
+		fmt.Fprintf(w, "kademlia_rpc_calls_total{method=%q} %d\n", method, m.calls[method])
+	}
+
+	fmt.Fprintln(w, "# HELP kademlia_rpc_errors_total Outbound RPCs that failed, by method and kind of failure.")
+	fmt.Fprintln(w, "# TYPE kademlia_rpc_errors_total counter")
+	errorKeys := make([]rpcErrorKey, 0, len(m.errors))
+	for key := range m.errors {
+		errorKeys = append(errorKeys, key)
+	}
+	sort.Slice(errorKeys, func(a, b int) bool {
+		if errorKeys[a].method != errorKeys[b].method {
+			return errorKeys[a].method < errorKeys[b].method
+		}
+		return errorKeys[a].kind < errorKeys[b].kind
+	})
+	for _, key := range errorKeys {
+		fmt.Fprintf(w, "kademlia_rpc_errors_total{method=%q,kind=%q} %d\n", key.method, key.kind, m.errors[key])
+	}
+
+	fmt.Fprintln(w, "# HELP kademlia_rpc_duration_seconds Time outbound RPCs took, by method.")
+	fmt.Fprintln(w, "# TYPE kademlia_rpc_duration_seconds histogram")
+	methods := make([]string, 0, len(m.rpcLatency))
+	for method := range m.rpcLatency {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		m.rpcLatency[method].write(w, "kademlia_rpc_duration_seconds", fmt.Sprintf("method=%q", method))
+	}
+
+	fmt.Fprintln(w, "# HELP kademlia_rpc_served_total Inbound RPCs handled, by method.")
+	fmt.Fprintln(w, "# TYPE kademlia_rpc_served_total counter")
+	for _, method := range sortedKeys(m.served) {
+		fmt.Fprintf(w, "kademlia_rpc_served_total{method=%q} %d\n", method, m.served[method])
+	}
+	fmt.Fprintln(w, "# HELP kademlia_rpc_served_errors_total Inbound RPCs that were refused or failed, by method.")
+	fmt.Fprintln(w, "# TYPE kademlia_rpc_served_errors_total counter")
+	for _, method := range sortedKeys(m.servedErrors) {
+		fmt.Fprintf(w, "kademlia_rpc_served_errors_total{method=%q} %d\n", method, m.servedErrors[method])
+	}
+
+	fmt.Fprintln(w, "# HELP kademlia_lookup_duration_seconds Time iterative lookups took.")
+	fmt.Fprintln(w, "# TYPE kademlia_lookup_duration_seconds histogram")
+	m.lookupLatency.write(w, "kademlia_lookup_duration_seconds", "")
+	fmt.Fprintln(w, "# HELP kademlia_lookup_hops Rounds of queries iterative lookups took.")
+	fmt.Fprintln(w, "# TYPE kademlia_lookup_hops histogram")
+	m.lookupHops.write(w, "kademlia_lookup_hops", "")
+
+	fmt.Fprintln(w, "# HELP kademlia_bucket_contacts Contacts in each k-bucket, by index and depth in the routing tree.")
+	fmt.Fprintln(w, "# TYPE kademlia_bucket_contacts gauge")
+	total := 0
+	for i, bucket := range buckets {
+		fmt.Fprintf(w, "kademlia_bucket_contacts{bucket=\"%d\",depth=\"%d\"} %d\n", i, bucket.depth, bucket.contacts)
+		total += bucket.contacts
+	}
+	fmt.Fprintln(w, "# HELP kademlia_routing_table_contacts Contacts in the routing table.")
+	fmt.Fprintln(w, "# TYPE kademlia_routing_table_contacts gauge")
+	fmt.Fprintf(w, "kademlia_routing_table_contacts %d\n", total)
+	fmt.Fprintln(w, "# HELP kademlia_routing_table_buckets K-buckets in the routing table.")
+	fmt.Fprintln(w, "# TYPE kademlia_routing_table_buckets gauge")
+	fmt.Fprintf(w, "kademlia_routing_table_buckets %d\n", len(buckets))
+	fmt.Fprintln(w, "# HELP kademlia_stored_keys Records held by this node.")
+	fmt.Fprintln(w, "# TYPE kademlia_stored_keys gauge")
+	fmt.Fprintf(w, "kademlia_stored_keys %d\n", keys)
+	fmt.Fprintln(w, "# HELP kademlia_stored_bytes Bytes of value held by this node.")
+	fmt.Fprintln(w, "# TYPE kademlia_stored_bytes gauge")
+	fmt.Fprintf(w, "kademlia_stored_bytes %d\n", size)
+	fmt.Fprintln(w, "# HELP kademlia_vdos Vanishing data objects held by this node.")
+	fmt.Fprintln(w, "# TYPE kademlia_vdos gauge")
+	fmt.Fprintf(w, "kademlia_vdos %d\n", vdos)
+}
+
+// Returns a handler serving WriteMetrics. With the default HTTPTransport it
+// is already served at /metrics on the node's listener.
+func (k *Kademlia) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		k.WriteMetrics(w)
+	})
+}
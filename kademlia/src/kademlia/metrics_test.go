@@ -0,0 +1,100 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad1 := newMemoryNode(network, "")
+	kad2 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+	ctx := context.Background()
+
+	if _, err := kad1.Ping(ctx, kad2.SelfContact.Host, kad2.SelfContact.Port); err != nil {
+		t.Fatal("TestMetricsEndpoint: Ping failed:", err)
+	}
+	// nobody listens on this one
+	kad1.Ping(ctx, net.IPv4(10, 255, 255, 255), 7890)
+	if _, err := kad1.IterativeStore(ctx, NewRandomID(), []byte("metrics")); err != nil {
+		t.Fatal("TestMetricsEndpoint: IterativeStore failed:", err)
+	}
+
+	resp := httptest.NewRecorder()
+	kad1.MetricsHandler().ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(resp.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Error("TestMetricsEndpoint: Wrong content type", resp.Header().Get("Content-Type"))
+	}
+	body := resp.Body.Bytes()
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(string(body), "\n") {
+		lines[line] = true
+	}
+
+	for _, expected := range []string{
+		`kademlia_rpc_calls_total{method="Ping"} 2`,
+		`kademlia_rpc_calls_total{method="Store"} 1`,
+		`kademlia_rpc_errors_total{method="Ping",kind="unreachable"} 1`,
+		`kademlia_rpc_duration_seconds_count{method="Ping"} 2`,
+		`kademlia_rpc_duration_seconds_bucket{method="Ping",le="+Inf"} 2`,
+		`kademlia_lookup_duration_seconds_count 1`,
+		`kademlia_lookup_hops_bucket{le="1"} 1`,
+		`kademlia_bucket_contacts{bucket="0",depth="0"} 1`,
+		`kademlia_routing_table_contacts 1`,
+		`kademlia_vdos 0`,
+		"# TYPE kademlia_lookup_hops histogram",
+	} {
+		if !lines[expected] {
+			t.Errorf("TestMetricsEndpoint: Missing %q", expected)
+		}
+	}
+
+	// an unsigned ping is refused
+	(&KademliaCore{kad2}).Ping(PingMessage{MsgID: NewRandomID()}, new(PongMessage))
+	var buf strings.Builder
+	kad2.WriteMetrics(&buf)
+	for _, expected := range []string{
+		"kademlia_stored_keys 1",
+		"kademlia_stored_bytes 7",
+		`kademlia_rpc_served_total{method="Ping"} 2`,
+		`kademlia_rpc_served_total{method="Store"} 1`,
+		`kademlia_rpc_served_errors_total{method="Ping"} 1`,
+	} {
+		if !strings.Contains(buf.String(), "\n"+expected+"\n") {
+			t.Errorf("TestMetricsEndpoint: Missing %q on the node served", expected)
+		}
+	}
+}
+
+// Takes the node's locks on every write, which deadlocks if WriteMetrics
+// holds them while writing.
+type lockingWriter struct {
+	kad *Kademlia
+}
+
+func (w lockingWriter) Write(p []byte) (int, error) {
+	w.kad.metrics.rpcDone("Ping", 0, nil)
+	w.kad.FindKBucket(NewRandomID())
+	return len(p), nil
+}
+
+func TestWriteMetricsHoldsNoLocks(t *testing.T) {
+	kad := newMemoryNode(NewMemoryNetwork(), "")
+	defer kad.Close()
+	done := make(chan bool)
+	go func() {
+		kad.WriteMetrics(lockingWriter{kad})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestWriteMetricsHoldsNoLocks: WriteMetrics held a lock while writing")
+	}
+}
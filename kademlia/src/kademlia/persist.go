@@ -0,0 +1,135 @@
+package kademlia
+
+// Contains what a node keeps in its data directory so that it can restart
+// with the same identity and contacts.
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	nodeKeyFile  = "node_key"
+	contactsFile = "contacts"
+	storeFile    = "store.log"
+	// the values this node republishes, see Kademlia.published
+	publishedFile = "published.log"
+)
+
+// Returns the private key saved in dir, or saves a new one solving the
+// crypto puzzle at difficulty if there is none. The node ID is derived from
+// it.
+func loadOrCreateKey(dir string, difficulty int) (ed25519.PrivateKey, error) {
+	path := filepath.Join(dir, nodeKeyFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, errors.New("malformed key in " + path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := GenerateIdentity(difficulty)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeFileAtomic(path, []byte(hex.EncodeToString(key.Seed())+"\n"))
+}
+
+// Writes data to a temporary file and renames it over path, so a crash
+// leaves either the old or the new contents.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Reads a contacts snapshot, one "nodeID host:port [publickey]" line per
+// contact.
+func loadContacts(dir string) ([]Contact, error) {
+	f, err := os.Open(filepath.Join(dir, contactsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var contacts []Contact
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, errors.New("malformed contact line: " + scanner.Text())
+		}
+		id, err := IDFromString(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		host, portstr, err := net.SplitHostPort(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseUint(portstr, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		c := Contact{NodeID: id, Host: net.ParseIP(host), Port: uint16(port)}
+		if len(fields) == 3 {
+			if c.PublicKey, err = hex.DecodeString(fields[2]); err != nil {
+				return nil, err
+			}
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, scanner.Err()
+}
+
+// Writes every contact in the routing table to the data directory. Does
+// nothing if the node has no Config.DataDir.
+func (k *Kademlia) SaveContacts() error {
+	if k.Config.DataDir == "" {
+		return nil
+	}
+	var buf strings.Builder
+	k.BucketMutexLock.Lock()
+	for _, bucket := range k.BucketList {
+		for _, c := range bucket.ContactList {
+			buf.WriteString(c.NodeID.AsString() + " " +
+				net.JoinHostPort(c.Host.String(), strconv.Itoa(int(c.Port))))
+			if len(c.PublicKey) > 0 {
+				buf.WriteString(" " + hex.EncodeToString(c.PublicKey))
+			}
+			buf.WriteString("\n")
+		}
+	}
+	k.BucketMutexLock.Unlock()
+	return writeFileAtomic(filepath.Join(k.Config.DataDir, contactsFile), []byte(buf.String()))
+}
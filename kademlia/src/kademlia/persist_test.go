@@ -0,0 +1,133 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestartFromDataDir(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := DefaultConfig()
+	config.DataDir = dir
+
+	kad1 := NewKademliaWithConfig("localhost:9050", config)
+	kad2 := NewKademlia("localhost:9051")
+	defer kad2.Close()
+	id := kad1.NodeID
+	if _, err := kad1.Ping(context.Background(), net.IPv4(127, 0, 0, 1), 9051); err != nil {
+		t.Fatal("TestRestartFromDataDir: Ping failed:", err)
+	}
+	key := NewRandomID()
+	if err := kad2.Store(context.Background(), &kad1.SelfContact, key, []byte("kept")); err != nil {
+		t.Fatal("TestRestartFromDataDir: Store failed:", err)
+	}
+	kad1.Close()
+	for _, name := range []string{nodeKeyFile, contactsFile, storeFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error("TestRestartFromDataDir: Missing " + name + " in the data directory")
+		}
+	}
+
+	// the restarted node listens elsewhere, peers have to learn the new port
+	kad1 = NewKademliaWithConfig("localhost:9052", config)
+	defer kad1.Close()
+	if !kad1.NodeID.Equals(id) {
+		t.Fatal("TestRestartFromDataDir: Node ID was not reused")
+	}
+	report, err := kad1.Bootstrap(context.Background())
+	if err != nil || len(report.Responded) != 1 {
+		t.Fatal("TestRestartFromDataDir: Saved contacts were not pinged:", err)
+	}
+	if _, err := kad1.FindContact(kad2.NodeID); err != nil {
+		t.Error("TestRestartFromDataDir: Routing table was not rebuilt")
+	}
+	if c, err := kad2.FindContact(id); err != nil || c.Port != 9052 {
+		t.Error("TestRestartFromDataDir: Peer did not learn the new address")
+	}
+	if val, err := kad1.LocalValue(key); err != nil || !bytes.Equal(val, []byte("kept")) {
+		t.Error("TestRestartFromDataDir: Stored value was lost")
+	}
+}
+
+func TestRepublishAfterRestart(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	network := NewMemoryNetwork()
+	peer := newMemoryNode(network, "")
+	defer peer.Close()
+	config := DefaultConfig()
+	config.DataDir = dir
+	config.RepublishInterval = 100 * time.Millisecond
+	config.Transport = network.Transport()
+	ctx := context.Background()
+
+	kad := NewKademliaWithConfig("", config)
+	if _, err := kad.Ping(ctx, peer.SelfContact.Host, peer.SelfContact.Port); err != nil {
+		t.Fatal("TestRepublishAfterRestart: Ping failed:", err)
+	}
+	key := NewRandomID()
+	if _, err := kad.IterativeStore(ctx, key, []byte("republished")); err != nil {
+		t.Fatal("TestRepublishAfterRestart: IterativeStore failed:", err)
+	}
+	first, _, _ := peer.Table.Get(key)
+	kad.Close()
+
+	// the restarted node still knows what it published
+	config.Transport = network.Transport()
+	kad = NewKademliaWithConfig("", config)
+	defer kad.Close()
+	if _, err := kad.Bootstrap(ctx); err != nil {
+		t.Fatal("TestRepublishAfterRestart: Bootstrap failed:", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec, _, _ := peer.Table.Get(key)
+		if rec.Published.After(first.Published) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("TestRepublishAfterRestart: Value was not republished after the restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOpenKademliaErrors(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, nodeKeyFile), []byte("not a key\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.DataDir = dir
+	config.Transport = NewMemoryNetwork().Transport()
+	if kad, err := OpenKademlia("", config); err == nil {
+		kad.Close()
+		t.Error("TestOpenKademliaErrors: Malformed key was accepted")
+	}
+
+	config.DataDir = ""
+	kad, err := OpenKademlia("", config)
+	if err != nil {
+		t.Fatal("TestOpenKademliaErrors: OpenKademlia failed:", err)
+	}
+	defer kad.Close()
+	if kad.Config.Store != kad.Table {
+		t.Error("TestOpenKademliaErrors: Config.Store is not the store in use")
+	}
+}
@@ -0,0 +1,171 @@
+package kademlia
+
+// Contains the pool of RPC connections shared by all outbound calls.
+
+import (
+	"context"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Pooled connections are keyed by where they lead.
+type poolKey struct {
+	host string
+	port uint16
+	path string
+}
+
+func poolKeyFor(contact *Contact) poolKey {
+	return poolKey{
+		host: contact.Host.String(),
+		port: contact.Port,
+		path: rpc.DefaultRPCPath + strconv.Itoa(int(contact.Port)),
+	}
+}
+
+type idleClient struct {
+	client *rpc.Client
+	since  time.Time
+}
+
+// Keeps RPC clients open between calls so that each RPC does not pay for a
+// new TCP connection and HTTP CONNECT. A client is taken out with Get and
+// handed back with Put once the call is done; clients whose connection broke
+// are closed with Discard instead.
+type ClientPool struct {
+	maxIdle     int
+	idleTimeout time.Duration
+	mutex       sync.Mutex
+	idle        map[poolKey][]idleClient
+	numIdle     int
+	closed      bool
+	done        chan bool
+}
+
+func NewClientPool(maxIdle int, idleTimeout time.Duration) *ClientPool {
+	p := new(ClientPool)
+	p.maxIdle = maxIdle
+	p.idleTimeout = idleTimeout
+	p.idle = make(map[poolKey][]idleClient)
+	p.done = make(chan bool)
+	go p.reap()
+	return p
+}
+
+// Returns an idle client connected to contact, dialing a new one if there is
+// none.
+func (p *ClientPool) Get(ctx context.Context, contact *Contact) (*rpc.Client, error) {
+	key := poolKeyFor(contact)
+	p.mutex.Lock()
+	clients := p.idle[key]
+	if len(clients) > 0 {
+		// most recently used first, it is the least likely to be stale
+		c := clients[len(clients)-1]
+		p.idle[key] = clients[:len(clients)-1]
+		if len(p.idle[key]) == 0 {
+			delete(p.idle, key)
+		}
+		p.numIdle -= 1
+		p.mutex.Unlock()
+		return c.client, nil
+	}
+	p.mutex.Unlock()
+	return p.Dial(ctx, contact)
+}
+
+// Opens a new client to contact without looking at the idle ones.
+func (p *ClientPool) Dial(ctx context.Context, contact *Contact) (*rpc.Client, error) {
+	key := poolKeyFor(contact)
+	address := key.host + ":" + strconv.Itoa(int(key.port))
+	return dialHTTPPath(ctx, address, key.path)
+}
+
+// Hands a healthy client back to the pool. If the pool already holds
+// maxIdle clients, the client is closed.
+func (p *ClientPool) Put(contact *Contact, client *rpc.Client) {
+	key := poolKeyFor(contact)
+	p.mutex.Lock()
+	if p.closed || p.numIdle >= p.maxIdle {
+		p.mutex.Unlock()
+		client.Close()
+		return
+	}
+	p.idle[key] = append(p.idle[key], idleClient{client, time.Now()})
+	p.numIdle += 1
+	p.mutex.Unlock()
+}
+
+// Closes a client whose connection is broken so it is never reused.
+func (p *ClientPool) Discard(client *rpc.Client) {
+	client.Close()
+}
+
+// Number of clients currently sitting idle in the pool.
+func (p *ClientPool) Idle() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.numIdle
+}
+
+// Closes every idle client and stops the reaper.
+func (p *ClientPool) Close() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = make(map[poolKey][]idleClient)
+	p.numIdle = 0
+	p.mutex.Unlock()
+
+	close(p.done)
+	for _, clients := range idle {
+		for _, c := range clients {
+			c.client.Close()
+		}
+	}
+}
+
+// Closes clients that have been idle for longer than idleTimeout.
+func (p *ClientPool) reap() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			p.closeIdleSince(now.Add(-p.idleTimeout))
+		}
+	}
+}
+
+func (p *ClientPool) closeIdleSince(cutoff time.Time) {
+	expired := make([]*rpc.Client, 0)
+	p.mutex.Lock()
+	for key, clients := range p.idle {
+		kept := clients[:0]
+		for _, c := range clients {
+			if c.since.Before(cutoff) {
+				expired = append(expired, c.client)
+			} else {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = kept
+		}
+	}
+	p.numIdle -= len(expired)
+	p.mutex.Unlock()
+
+	for _, client := range expired {
+		client.Close()
+	}
+}
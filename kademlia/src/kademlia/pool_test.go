@@ -0,0 +1,74 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPoolReusesClients(t *testing.T) {
+	NewKademlia("localhost:9020")
+	con := &Contact{Host: net.IPv4(127, 0, 0, 1), Port: 9020}
+
+	pool := NewClientPool(1, time.Minute)
+	defer pool.Close()
+	first, err := pool.Get(context.Background(), con)
+	if err != nil {
+		t.Fatal("TestPoolReusesClients: Could not dial:", err)
+	}
+	second, err := pool.Get(context.Background(), con)
+	if err != nil {
+		t.Fatal("TestPoolReusesClients: Could not dial:", err)
+	}
+	if first == second {
+		t.Error("TestPoolReusesClients: A client was handed out twice")
+	}
+
+	pool.Put(con, first)
+	pool.Put(con, second)
+	if pool.Idle() != 1 {
+		t.Error("TestPoolReusesClients: Pool kept more idle clients than allowed")
+	}
+	again, _ := pool.Get(context.Background(), con)
+	if again != first {
+		t.Error("TestPoolReusesClients: Idle client was not reused")
+	}
+}
+
+func TestPoolClosesIdleClients(t *testing.T) {
+	NewKademlia("localhost:9021")
+	con := &Contact{Host: net.IPv4(127, 0, 0, 1), Port: 9021}
+
+	pool := NewClientPool(4, 20*time.Millisecond)
+	defer pool.Close()
+	client, err := pool.Get(context.Background(), con)
+	if err != nil {
+		t.Fatal("TestPoolClosesIdleClients: Could not dial:", err)
+	}
+	pool.Put(con, client)
+	time.Sleep(100 * time.Millisecond)
+	if pool.Idle() != 0 {
+		t.Error("TestPoolClosesIdleClients: Idle client was not closed")
+	}
+}
+
+func TestPoolReplacesBrokenClients(t *testing.T) {
+	kad1 := NewKademlia("localhost:9022")
+	kad2 := NewKademlia("localhost:9023")
+	if _, err := kad1.Ping(context.Background(), net.IPv4(127, 0, 0, 1), 9023); err != nil {
+		t.Fatal("TestPoolReplacesBrokenClients: Ping failed:", err)
+	}
+	if kad1.transport.(*HTTPTransport).pool.Idle() != 1 {
+		t.Error("TestPoolReplacesBrokenClients: Connection was not pooled")
+	}
+
+	// break the pooled connection, the next call has to dial again
+	con := kad2.SelfContact
+	client, _ := kad1.transport.(*HTTPTransport).pool.Get(context.Background(), &con)
+	client.Close()
+	kad1.transport.(*HTTPTransport).pool.Put(&con, client)
+	if _, err := kad1.Ping(context.Background(), con.Host, con.Port); err != nil {
+		t.Error("TestPoolReplacesBrokenClients: Ping over a broken pooled connection failed:", err)
+	}
+}
@@ -0,0 +1,51 @@
+package kademlia
+
+// Contains the static crypto puzzle node IDs can be required to solve, as in
+// S/Kademlia. Since an ID is the hash of a public key, solving it means
+// trying keys until one hashes to an ID that passes, which costs about
+// 2^difficulty key generations and makes choosing where in the ID space to
+// place a node expensive.
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+)
+
+var errPuzzle = errors.New("node ID does not solve the crypto puzzle")
+
+// Reports whether id solves the puzzle at difficulty, that is whether the
+// SHA-1 hash of id starts with at least difficulty zero bits. Every ID passes
+// at difficulty 0.
+func VerifyNodeID(id ID, difficulty int) bool {
+	if difficulty <= 0 {
+		return true
+	}
+	return ID(sha1.Sum(id[:])).PrefixLen() >= difficulty
+}
+
+// Generates a key whose node ID solves the puzzle at difficulty.
+func GenerateIdentity(difficulty int) (ed25519.PrivateKey, error) {
+	if difficulty > 8*IDBytes {
+		return nil, fmt.Errorf("difficulty %d is out of range", difficulty)
+	}
+	for {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if VerifyNodeID(NodeIDFromPublicKey(pub), difficulty) {
+			return priv, nil
+		}
+	}
+}
+
+// Checks a contact's ID against Config.IDDifficulty.
+func (k *Kademlia) checkPuzzle(id ID) error {
+	if !VerifyNodeID(id, k.Config.IDDifficulty) {
+		return errPuzzle
+	}
+	return nil
+}
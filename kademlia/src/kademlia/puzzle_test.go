@@ -0,0 +1,75 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestIDPuzzle(t *testing.T) {
+	key, err := GenerateIdentity(8)
+	if err != nil {
+		t.Fatal("TestIDPuzzle: GenerateIdentity failed:", err)
+	}
+	id := NodeIDFromPublicKey(key.Public().(ed25519.PublicKey))
+	if !VerifyNodeID(id, 8) || !VerifyNodeID(id, 0) {
+		t.Error("TestIDPuzzle: Generated ID does not solve the puzzle")
+	}
+	if _, err := GenerateIdentity(8*IDBytes + 1); err == nil {
+		t.Error("TestIDPuzzle: Impossible difficulty was accepted")
+	}
+}
+
+// Returns a key whose ID does not solve the puzzle at difficulty.
+func unsolvedKey(difficulty int) ed25519.PrivateKey {
+	for {
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		if !VerifyNodeID(NodeIDFromPublicKey(pub), difficulty) {
+			return priv
+		}
+	}
+}
+
+func TestPuzzleRejectsContacts(t *testing.T) {
+	network := NewMemoryNetwork()
+	config := DefaultConfig()
+	config.Transport = network.Transport()
+	config.IDDifficulty = 8
+	kad := NewKademliaWithConfig("", config)
+	defer kad.Close()
+	if !VerifyNodeID(kad.NodeID, 8) {
+		t.Error("TestPuzzleRejectsContacts: Node generated an ID that does not solve the puzzle")
+	}
+
+	config.Transport = network.Transport()
+	honest := NewKademliaWithConfig("", config)
+	defer honest.Close()
+	config.Transport = network.Transport()
+	config.IDDifficulty = 0
+	config.PrivateKey = unsolvedKey(8)
+	cheap := NewKademliaWithConfig("", config)
+	defer cheap.Close()
+	ctx := context.Background()
+
+	if _, err := honest.Ping(ctx, kad.SelfContact.Host, kad.SelfContact.Port); err != nil {
+		t.Fatal("TestPuzzleRejectsContacts: Ping with a valid ID failed:", err)
+	}
+	if _, err := kad.FindContact(honest.NodeID); err != nil {
+		t.Error("TestPuzzleRejectsContacts: Contact with a valid ID was not added")
+	}
+
+	// a request from an ID without the work behind it is refused...
+	if _, err := cheap.Ping(ctx, kad.SelfContact.Host, kad.SelfContact.Port); err == nil {
+		t.Error("TestPuzzleRejectsContacts: Ping from an unsolved ID was accepted")
+	}
+	if err := cheap.Store(ctx, &kad.SelfContact, NewRandomID(), []byte("x")); err == nil {
+		t.Error("TestPuzzleRejectsContacts: STORE from an unsolved ID was accepted")
+	}
+	// ...and so is a reply from one
+	if _, err := kad.Ping(ctx, cheap.SelfContact.Host, cheap.SelfContact.Port); err == nil {
+		t.Error("TestPuzzleRejectsContacts: Pong from an unsolved ID was accepted")
+	}
+	if _, err := kad.FindContact(cheap.NodeID); err == nil {
+		t.Error("TestPuzzleRejectsContacts: Contact with an unsolved ID was added")
+	}
+}
@@ -0,0 +1,262 @@
+package kademlia
+
+// Contains stored records and the background work that expires, replicates
+// and republishes them.
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// A value stored on this node, along with who published it and when.
+type Record struct {
+	Value []byte
+	// the node that originally stored the value on the network
+	Publisher ID
+	// when the publisher last stored the value; replicas keep this time
+	Published time.Time
+	// the record is dropped after this time, unless republished
+	Expires time.Time
+	// when this node last received or replicated the record
+	Stored time.Time
+	// the record is a copy cached by a lookup; it expires after
+	// Config.CacheTTL and is not replicated
+	Cached bool
+}
+
+// How far ahead of our clock the publish time of a STORE may be. Records
+// dated any later would outlive their TTL, and could not be replaced by the
+// real publisher's republish.
+const maxClockSkew = time.Minute
+
+func (r Record) expired(now time.Time) bool {
+	return !r.Expires.After(now)
+}
+
+// Saves a record received from the network. A record that is older than the
+// one already held, or that has already expired, is ignored, and so is a
+// cached copy of the record already held. Content, see content.go, is only
+// replaced by content, and always replaces a value that is not.
+func (k *Kademlia) putRecord(key ID, value []byte, publisher ID, published time.Time, cached bool) error {
+	now := time.Now()
+	valueCopy := make([]byte, len(value))
+	copy(valueCopy, value)
+	rec := Record{
+		Value:     valueCopy,
+		Publisher: publisher,
+		Published: published,
+		Expires:   published.Add(k.Config.RecordTTL),
+		Stored:    now,
+		Cached:    cached,
+	}
+	if cached && rec.Expires.After(now.Add(k.Config.CacheTTL)) {
+		rec.Expires = now.Add(k.Config.CacheTTL)
+	}
+	if rec.expired(now) {
+		return nil
+	}
+
+	// the lock makes the check and the write one step
+	k.TableMutexLock.Lock()
+	defer k.TableMutexLock.Unlock()
+	old, ok, err := k.Table.Get(key)
+	if err != nil {
+		log.Println("Get:", err)
+		return nil
+	}
+	if ok && !old.expired(now) {
+		oldContent := contentHash(key, old.Value) != NoHash
+		newContent := contentHash(key, value) != NoHash
+		if oldContent && !newContent {
+			return errContentOverwrite
+		}
+		if oldContent == newContent && old.Published.After(published) {
+			return nil
+		}
+		if oldContent == newContent && cached && !old.Cached && old.Published.Equal(published) {
+			return nil
+		}
+	}
+	if err := k.Table.Put(key, rec); err != nil {
+		log.Println("Put:", err)
+	}
+	return nil
+}
+
+// Returns the record held under key, if there is one and it has not expired.
+func (k *Kademlia) liveRecord(key ID) (Record, bool) {
+	rec, ok, err := k.Table.Get(key)
+	if err != nil || !ok || rec.expired(time.Now()) || len(rec.Value) == 0 {
+		return Record{}, false
+	}
+	return rec, true
+}
+
+// Returns the value held under key, or nil if there is none or it expired.
+func (k *Kademlia) getRecord(key ID) []byte {
+	rec, _ := k.liveRecord(key)
+	return rec.Value
+}
+
+// Sends a single STORE carrying the record's publisher and timestamp.
+func (k *Kademlia) storeRecord(ctx context.Context, contact *Contact, key ID, rec Record) error {
+	request := new(StoreRequest)
+	request.Sender = k.SelfContact
+	request.Key = key
+	request.Value = rec.Value
+	request.Hash = k.contentKind(key, rec.Value)
+	request.Publisher = rec.Publisher
+	request.Published = rec.Published
+	request.Cached = rec.Cached
+	request.MsgID = NewRandomID()
+
+	var result StoreResult
+	err := k.callRPC(ctx, contact, "KademliaCore.Store", request, &result)
+	if err == nil && result.Err != nil {
+		err = &RPCError{
+			Kind:    ErrRemote,
+			Method:  "KademliaCore.Store",
+			Contact: *contact,
+			Err:     result.Err,
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// update contact in kbucket of this kademlia
+	k.UpdateContactInKBucket(contact)
+	return nil
+}
+
+// Starts expiring, replicating and republishing records in the background.
+// Expired records are swept every Config.SweepInterval. Records not stored
+// for Config.ReplicateInterval are pushed to the k closest nodes, and values
+// this node published are stored again after Config.RepublishInterval. The
+// latter two are checked every quarter of their interval. Calling it again
+// while running has no effect.
+func (k *Kademlia) StartRepublisher() {
+	k.republishMutexLock.Lock()
+	defer k.republishMutexLock.Unlock()
+	if k.stopRepublish != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	k.stopRepublish = cancel
+
+	go func() {
+		sweep := time.NewTicker(k.Config.SweepInterval)
+		replicate := time.NewTicker(k.Config.ReplicateInterval / 4)
+		republish := time.NewTicker(k.Config.RepublishInterval / 4)
+		defer sweep.Stop()
+		defer replicate.Stop()
+		defer republish.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sweep.C:
+				k.ExpireRecords()
+			case <-replicate.C:
+				k.ReplicateRecords(ctx)
+			case <-republish.C:
+				k.RepublishRecords(ctx)
+			}
+		}
+	}()
+}
+
+// Stops the background republisher, if it is running.
+func (k *Kademlia) StopRepublisher() {
+	k.republishMutexLock.Lock()
+	defer k.republishMutexLock.Unlock()
+	if k.stopRepublish != nil {
+		k.stopRepublish()
+		k.stopRepublish = nil
+	}
+}
+
+// Deletes every expired record. Returns how many were deleted.
+func (k *Kademlia) ExpireRecords() int {
+	now := time.Now()
+	var expired []ID
+	k.Table.Iterate(func(key ID, rec Record) bool {
+		if rec.expired(now) {
+			expired = append(expired, key)
+		}
+		return true
+	})
+
+	k.TableMutexLock.Lock()
+	defer k.TableMutexLock.Unlock()
+	count := 0
+	for _, key := range expired {
+		// it may have been stored again since
+		if rec, ok, err := k.Table.Get(key); err == nil && ok && rec.expired(now) {
+			if k.Table.Delete(key) == nil {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Stores every record that has not been received or replicated for
+// Config.ReplicateInterval on the k closest nodes to its key, keeping the
+// original publisher and timestamp. Nodes that recently got a STORE for a
+// key skip it, so each record is usually replicated by one node per hour.
+// Cached copies are left to expire.
+func (k *Kademlia) ReplicateRecords(ctx context.Context) {
+	cutoff := time.Now().Add(-k.Config.ReplicateInterval)
+	now := time.Now()
+	due := make(map[ID]Record)
+	k.Table.Iterate(func(key ID, rec Record) bool {
+		if rec.Stored.Before(cutoff) && !rec.expired(now) && !rec.Cached {
+			due[key] = rec
+		}
+		return true
+	})
+
+	for key, rec := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		contacts, err := k.IterativeFindNode(ctx, key)
+		if err != nil {
+			continue
+		}
+		for _, con := range contacts {
+			k.storeRecord(ctx, &con, key, rec)
+		}
+
+		k.TableMutexLock.Lock()
+		if cur, ok, err := k.Table.Get(key); err == nil && ok && cur.Published.Equal(rec.Published) {
+			cur.Stored = time.Now()
+			k.Table.Put(key, cur)
+		}
+		k.TableMutexLock.Unlock()
+	}
+}
+
+// Runs IterativeStore again for every value this node published more than
+// Config.RepublishInterval ago, which gives the value a new expiry.
+func (k *Kademlia) RepublishRecords(ctx context.Context) {
+	cutoff := time.Now().Add(-k.Config.RepublishInterval)
+	due := make(map[ID][]byte)
+	k.TableMutexLock.Lock()
+	k.published.Iterate(func(key ID, rec Record) bool {
+		if rec.Published.Before(cutoff) {
+			due[key] = rec.Value
+		}
+		return true
+	})
+	k.TableMutexLock.Unlock()
+
+	for key, value := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		k.IterativeStore(ctx, key, value)
+	}
+}
@@ -0,0 +1,213 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRecordExpiry(t *testing.T) {
+	config := DefaultConfig()
+	config.RecordTTL = 200 * time.Millisecond
+	config.SweepInterval = 20 * time.Millisecond
+	kad1 := NewKademlia("localhost:9041")
+	kad2 := NewKademliaWithConfig("localhost:9042", config)
+	defer kad1.Close()
+	defer kad2.Close()
+
+	key := NewRandomID()
+	value := []byte("expiring")
+	if err := kad1.Store(context.Background(), &kad2.SelfContact, key, value); err != nil {
+		t.Fatal("TestRecordExpiry: Store failed:", err)
+	}
+	rec, _, _ := kad2.Table.Get(key)
+	if !rec.Publisher.Equals(kad1.NodeID) || !rec.Expires.Equal(rec.Published.Add(config.RecordTTL)) {
+		t.Error("TestRecordExpiry: Record does not carry its publisher and expiry")
+	}
+
+	// records older than ones already held, or already expired, are ignored
+	kad2.putRecord(key, []byte("older"), kad1.NodeID, rec.Published.Add(-time.Millisecond), false)
+	kad2.putRecord(NewRandomID(), []byte("stale"), kad1.NodeID, time.Now().Add(-time.Second), false)
+	if val, err := kad2.LocalValue(key); err != nil || !bytes.Equal(val, value) {
+		t.Error("TestRecordExpiry: Older record replaced a newer one")
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if _, err := kad2.LocalValue(key); err == nil {
+		t.Error("TestRecordExpiry: Expired value is still served")
+	}
+	if kad2.Table.Size() != 0 {
+		t.Error("TestRecordExpiry: Expired records were not swept")
+	}
+}
+
+func TestFuturePublishTimeRefused(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad1 := newMemoryNode(network, "")
+	kad2 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+	ctx := context.Background()
+
+	key := NewRandomID()
+	rec := Record{Value: []byte("future"), Publisher: kad1.NodeID, Published: time.Now().Add(time.Hour)}
+	err := kad1.storeRecord(ctx, &kad2.SelfContact, key, rec)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Kind != ErrRemote {
+		t.Fatal("TestFuturePublishTimeRefused: STORE dated in the future was not refused:", err)
+	}
+	if _, err := kad2.LocalValue(key); err == nil {
+		t.Error("TestFuturePublishTimeRefused: Record dated in the future was stored")
+	}
+
+	// clocks a little ahead are fine
+	rec.Published = time.Now().Add(maxClockSkew / 2)
+	if err := kad1.storeRecord(ctx, &kad2.SelfContact, key, rec); err != nil {
+		t.Error("TestFuturePublishTimeRefused: STORE within the clock skew was refused:", err)
+	}
+}
+
+func TestCachedCopies(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad1 := newMemoryNode(network, "")
+	kad2 := newMemoryNode(network, "")
+	kad3 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+	defer kad3.Close()
+	ctx := context.Background()
+	// node 1 only knows node 2, which only knows node 3
+	kad1.Ping(ctx, kad2.SelfContact.Host, kad2.SelfContact.Port)
+	kad2.Ping(ctx, kad3.SelfContact.Host, kad3.SelfContact.Port)
+
+	key := NewRandomID()
+	value := []byte("cached")
+	publisher := NewRandomID()
+	published := time.Now().Add(-time.Minute)
+	kad3.putRecord(key, value, publisher, published, false)
+
+	if _, _, err := kad1.IterativeFindValue(ctx, key); err != nil {
+		t.Fatal("TestCachedCopies: IterativeFindValue failed:", err)
+	}
+	rec, ok, _ := kad2.Table.Get(key)
+	if !ok || !rec.Cached {
+		t.Fatal("TestCachedCopies: Value was not cached on node 2")
+	}
+	// reading the value must not make it live any longer
+	if !rec.Publisher.Equals(publisher) || !rec.Published.Equal(published) {
+		t.Error("TestCachedCopies: Cached copy lost its publisher or timestamp")
+	}
+	if rec.Expires.After(time.Now().Add(kad2.Config.CacheTTL)) {
+		t.Error("TestCachedCopies: Cached copy outlives the cache TTL")
+	}
+
+	// a cached copy does not shorten the life of the original
+	kad3.putRecord(key, value, publisher, published, true)
+	if rec, _, _ := kad3.Table.Get(key); rec.Cached {
+		t.Error("TestCachedCopies: Cached copy replaced the original")
+	}
+}
+
+func TestReplicateRecords(t *testing.T) {
+	config := DefaultConfig()
+	config.ReplicateInterval = 100 * time.Millisecond
+	kad1 := NewKademliaWithConfig("localhost:9043", config)
+	kad2 := NewKademlia("localhost:9044")
+	defer kad1.Close()
+	defer kad2.Close()
+	if _, err := kad1.Ping(context.Background(), net.IPv4(127, 0, 0, 1), 9044); err != nil {
+		t.Fatal("TestReplicateRecords: Ping failed:", err)
+	}
+
+	key := NewRandomID()
+	publisher := NewRandomID()
+	published := time.Now().Add(-time.Minute)
+	kad1.putRecord(key, []byte("replicated"), publisher, published, false)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec, ok, _ := kad2.Table.Get(key)
+		if ok {
+			if !rec.Publisher.Equals(publisher) || !rec.Published.Equal(published) {
+				t.Error("TestReplicateRecords: Replica lost its publisher or timestamp")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("TestReplicateRecords: Record was never replicated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRepublishRecords(t *testing.T) {
+	config1 := DefaultConfig()
+	config1.RepublishInterval = 100 * time.Millisecond
+	config2 := DefaultConfig()
+	config2.RecordTTL = 300 * time.Millisecond
+	config2.SweepInterval = 20 * time.Millisecond
+	kad1 := NewKademliaWithConfig("localhost:9045", config1)
+	kad2 := NewKademliaWithConfig("localhost:9046", config2)
+	defer kad1.Close()
+	defer kad2.Close()
+	if _, err := kad1.Ping(context.Background(), net.IPv4(127, 0, 0, 1), 9046); err != nil {
+		t.Fatal("TestRepublishRecords: Ping failed:", err)
+	}
+
+	key := NewRandomID()
+	value := []byte("republished")
+	if _, err := kad1.IterativeStore(context.Background(), key, value); err != nil {
+		t.Fatal("TestRepublishRecords: IterativeStore failed:", err)
+	}
+	first, _, _ := kad2.Table.Get(key)
+
+	// well past the TTL the publisher has kept the value alive
+	time.Sleep(600 * time.Millisecond)
+	rec, ok, _ := kad2.Table.Get(key)
+	if !ok || !bytes.Equal(rec.Value, value) {
+		t.Fatal("TestRepublishRecords: Value expired despite republishing")
+	}
+	if !rec.Published.After(first.Published) {
+		t.Error("TestRepublishRecords: Republished record kept its old timestamp")
+	}
+}
+
+func TestVanishSharesAreNotRepublished(t *testing.T) {
+	network := NewMemoryNetwork()
+	config := DefaultConfig()
+	config.Transport = network.Transport()
+	config.RepublishInterval = 100 * time.Millisecond
+	kad1 := NewKademliaWithConfig("", config)
+	kad2 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+	ctx := context.Background()
+	kad1.Ping(ctx, kad2.SelfContact.Host, kad2.SelfContact.Port)
+
+	VanishData(ctx, kad1, []byte("vanishing"), 10, 5, 3600)
+	if kad2.Table.Size() != 10 {
+		t.Fatal("TestVanishSharesAreNotRepublished: Shares were not stored")
+	}
+	first := make(map[ID]time.Time)
+	kad2.Table.Iterate(func(key ID, rec Record) bool {
+		first[key] = rec.Published
+		return true
+	})
+
+	time.Sleep(300 * time.Millisecond)
+	kad2.Table.Iterate(func(key ID, rec Record) bool {
+		if !rec.Published.Equal(first[key]) {
+			t.Error("TestVanishSharesAreNotRepublished: Share was republished")
+			return false
+		}
+		return true
+	})
+	kad1.TableMutexLock.Lock()
+	defer kad1.TableMutexLock.Unlock()
+	if kad1.published.Size() != 0 {
+		t.Error("TestVanishSharesAreNotRepublished: Shares were kept for republishing")
+	}
+}
@@ -0,0 +1,86 @@
+package kademlia
+
+// Contains the background refresher that keeps idle k-buckets up to date.
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Records that a lookup for target just went through its k-bucket.
+func (k *Kademlia) touchBucket(target ID) {
+	k.BucketMutexLock.Lock()
+	k.BucketList[k.bucketIndex(target)].LastLookup = time.Now()
+	k.BucketMutexLock.Unlock()
+}
+
+// Returns a random ID that falls into the k-bucket with the given index in
+// BucketList.
+func (k *Kademlia) RandomIDInBucket(index int) ID {
+	k.BucketMutexLock.Lock()
+	defer k.BucketMutexLock.Unlock()
+	return k.BucketList[index].RandomID()
+}
+
+// Starts refreshing buckets in the background, see RefreshBuckets. Buckets
+// are checked every quarter of Config.RefreshInterval until StopRefresher or
+// Close is called, and the routing table is saved to Config.DataDir after
+// each check. Calling it again while running has no effect.
+func (k *Kademlia) StartRefresher() {
+	k.refreshMutexLock.Lock()
+	defer k.refreshMutexLock.Unlock()
+	if k.stopRefresh != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	k.stopRefresh = cancel
+
+	go func() {
+		ticker := time.NewTicker(k.Config.RefreshInterval / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				k.RefreshBuckets(ctx)
+				if err := k.SaveContacts(); err != nil {
+					log.Println("SaveContacts:", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stops the background refresher, if it is running.
+func (k *Kademlia) StopRefresher() {
+	k.refreshMutexLock.Lock()
+	defer k.refreshMutexLock.Unlock()
+	if k.stopRefresh != nil {
+		k.stopRefresh()
+		k.stopRefresh = nil
+	}
+}
+
+// Runs an iterative FIND_NODE for a random ID in every bucket that has not
+// seen a lookup for Config.RefreshInterval. This fills far away buckets and
+// lets contacts that went silent fail their way out of the table.
+func (k *Kademlia) RefreshBuckets(ctx context.Context) {
+	cutoff := time.Now().Add(-k.Config.RefreshInterval)
+	// the lookups may split buckets, so pick the IDs beforehand
+	targets := make([]ID, 0)
+	k.BucketMutexLock.Lock()
+	for _, bucket := range k.BucketList {
+		if bucket.LastLookup.Before(cutoff) {
+			targets = append(targets, bucket.RandomID())
+		}
+	}
+	k.BucketMutexLock.Unlock()
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			return
+		}
+		k.IterativeFindNode(ctx, target)
+	}
+}
@@ -0,0 +1,67 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRandomIDInBucket(t *testing.T) {
+	kad := newMemoryNode(NewMemoryNetwork(), "")
+	defer kad.Close()
+	for i := 0; i < 300; i++ {
+		con := Contact{NodeID: NewRandomID(), Host: net.IPv4(127, 0, 0, 1), Port: uint16(10000 + i)}
+		kad.UpdateContactInKBucket(&con)
+	}
+	if len(kad.BucketList) == 1 {
+		t.Fatal("TestRandomIDInBucket: Routing table never split")
+	}
+	for i := range kad.BucketList {
+		if _, index := kad.FindKBucket(kad.RandomIDInBucket(i)); index != i {
+			t.Errorf("TestRandomIDInBucket: ID for bucket %d landed in bucket %d", i, index)
+		}
+	}
+}
+
+func TestRefresherFillsBuckets(t *testing.T) {
+	network := NewMemoryNetwork()
+	config := DefaultConfig()
+	config.RefreshInterval = 40 * time.Millisecond
+	config.Transport = network.Transport()
+	kad1 := NewKademliaWithConfig("", config)
+	kad2 := newMemoryNode(network, "")
+	kad3 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+	defer kad3.Close()
+
+	// node 1 only knows node 2, which knows node 3. Refreshing node 1's
+	// buckets has to turn up node 3.
+	if _, err := kad1.Ping(context.Background(), kad2.SelfContact.Host, kad2.SelfContact.Port); err != nil {
+		t.Fatal("TestRefresherFillsBuckets: Ping failed:", err)
+	}
+	if _, err := kad3.Ping(context.Background(), kad2.SelfContact.Host, kad2.SelfContact.Port); err != nil {
+		t.Fatal("TestRefresherFillsBuckets: Ping failed:", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := kad1.FindContact(kad3.NodeID); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("TestRefresherFillsBuckets: Refresher never found node 3")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	kad1.StopRefresher()
+	bucket, _ := kad1.FindKBucket(NewRandomID())
+	kad1.BucketMutexLock.Lock()
+	last := bucket.LastLookup
+	kad1.BucketMutexLock.Unlock()
+	if time.Since(last) > time.Second {
+		t.Error("TestRefresherFillsBuckets: Bucket was not marked as refreshed")
+	}
+}
@@ -0,0 +1,95 @@
+package kademlia
+
+// Contains the routing table formed by the k-buckets and the queries against
+// it.
+//
+// The table is the binary tree of the paper, kept as the list of its leaves.
+// It starts out as a single bucket covering the whole ID space. A full bucket
+// whose range holds our own ID is split in two, so the table ends up with
+// one bucket per bit of distance near us and a few large ones for the far
+// away parts of the ID space. With Config.SplitBits above 1, other full
+// buckets are split as well while their depth is not a multiple of it,
+// which keeps more contacts from the parts of the tree we are not in.
+
+import (
+	"sort"
+)
+
+// Returns the index of the bucket whose range holds id. The caller holds
+// BucketMutexLock.
+func (k *Kademlia) bucketIndex(id ID) int {
+	// the first bucket has the all-zero prefix, so there is always one
+	return sort.Search(len(k.BucketList), func(i int) bool {
+		return id.Less(k.BucketList[i].Prefix)
+	}) - 1
+}
+
+// Reports whether a full bucket is split rather than have new contacts wait
+// in its replacement cache. The caller holds BucketMutexLock.
+func (k *Kademlia) splittable(bucket *KBucket) bool {
+	if bucket.Depth >= IDBits {
+		return false
+	}
+	if bucket.Covers(k.NodeID) {
+		return true
+	}
+	relaxed := k.Config.SplitBits
+	return relaxed > 1 && bucket.Depth%relaxed != 0
+}
+
+// Replaces the bucket at index with its two halves. The caller holds
+// BucketMutexLock.
+func (k *Kademlia) splitBucket(index int) {
+	low, high := k.BucketList[index].Split()
+	k.BucketList = append(k.BucketList, nil)
+	copy(k.BucketList[index+2:], k.BucketList[index+1:])
+	k.BucketList[index] = low
+	k.BucketList[index+1] = high
+}
+
+// Returns the smallest distance between target and an ID in the bucket.
+func (kb *KBucket) distanceFrom(target ID) ID {
+	// the bits past Depth can match those of target
+	return maskID(kb.Prefix.Xor(target), kb.Depth)
+}
+
+// Returns up to count contacts from the routing table, closest to target
+// first. Contacts with the exclude ID are skipped.
+//
+// Buckets cover disjoint subtrees of the ID space, so the distances from
+// target to the IDs of one bucket are either all smaller or all larger than
+// those to the IDs of another. Buckets are therefore read in order of their
+// distance and only as many as needed to fill count.
+func (k *Kademlia) ClosestContacts(target ID, count int, exclude ID) []Contact {
+	k.BucketMutexLock.Lock()
+	defer k.BucketMutexLock.Unlock()
+	buckets := make([]*KBucket, len(k.BucketList))
+	copy(buckets, k.BucketList)
+	sort.Slice(buckets, func(a, b int) bool {
+		return buckets[a].distanceFrom(target).Less(buckets[b].distanceFrom(target))
+	})
+
+	contacts := make([]Contact, 0, count)
+	for _, bucket := range buckets {
+		if len(contacts) >= count {
+			break
+		}
+		// contacts in each bucket are all closer than those in the next
+		// one, so only whole buckets need to be sorted
+		group := make([]Contact, 0, len(bucket.ContactList))
+		for _, con := range bucket.ContactList {
+			if con.Host != nil && !con.NodeID.Equals(exclude) {
+				group = append(group, con)
+			}
+		}
+		sort.Slice(group, func(a, b int) bool {
+			return closerTo(target, group[a].NodeID, group[b].NodeID)
+		})
+		contacts = append(contacts, group...)
+	}
+
+	if len(contacts) > count {
+		contacts = contacts[:count]
+	}
+	return contacts
+}
@@ -0,0 +1,180 @@
+package kademlia
+
+import (
+	"net"
+	"sort"
+	"testing"
+)
+
+func TestClosestContacts(t *testing.T) {
+	kad := NewKademlia("localhost:9027")
+
+	all := make([]Contact, 0)
+	for i := 0; i < 300; i++ {
+		con := Contact{NodeID: NewRandomID(), Host: net.IPv4(127, 0, 0, 1), Port: uint16(10000 + i)}
+		bucket, _ := kad.FindKBucket(con.NodeID)
+		// a full bucket holding our own ID is split to make room
+		if len(bucket.ContactList) == k && !bucket.Covers(kad.NodeID) {
+			continue
+		}
+		kad.UpdateContactInKBucket(&con)
+		all = append(all, con)
+	}
+
+	for trial := 0; trial < 20; trial++ {
+		target := NewRandomID()
+		if trial == 0 {
+			target = kad.NodeID
+		}
+		exclude := all[trial].NodeID
+
+		expected := make([]Contact, 0)
+		for _, con := range all {
+			if !con.NodeID.Equals(exclude) {
+				expected = append(expected, con)
+			}
+		}
+		sort.Slice(expected, func(a, b int) bool {
+			return closerTo(target, expected[a].NodeID, expected[b].NodeID)
+		})
+		expected = expected[:k]
+
+		got := kad.FindCloseContacts(target, exclude)
+		if len(got) != k {
+			t.Fatalf("TestClosestContacts: Expected %d contacts, got %d", k, len(got))
+		}
+		for i := range got {
+			if !got[i].NodeID.Equals(expected[i].NodeID) {
+				t.Fatalf("TestClosestContacts: Contact %d is %s, expected %s", i,
+					got[i].NodeID.AsString(), expected[i].NodeID.AsString())
+			}
+		}
+	}
+
+	if len(kad.ClosestContacts(NewRandomID(), 5, kad.NodeID)) != 5 {
+		t.Error("TestClosestContacts: Did not honour the requested count")
+	}
+}
+
+// Returns the first ID after the range of bucket, and false if the range
+// runs to the end of the ID space.
+func rangeEnd(bucket *KBucket) (ID, bool) {
+	next := bucket.Prefix
+	for bit := bucket.Depth - 1; bit >= 0; bit-- {
+		mask := uint8(0x80) >> uint(bit%8)
+		if next[bit/8]&mask == 0 {
+			next[bit/8] |= mask
+			return next, true
+		}
+		next[bit/8] &^= mask
+	}
+	return next, false
+}
+
+// Checks that the buckets of kad cover the ID space without gaps or
+// overlaps, that each holds at most k contacts, all within its range, and
+// that each was split off a bucket that was allowed to split. Returns the
+// number of contacts in the table.
+func checkRoutingTree(t *testing.T, name string, kad *Kademlia) int {
+	kad.BucketMutexLock.Lock()
+	defer kad.BucketMutexLock.Unlock()
+	relaxed := kad.Config.SplitBits
+
+	var start ID
+	more := true
+	contacts := 0
+	for i, bucket := range kad.BucketList {
+		if !more {
+			t.Fatalf("%s: Bucket %d lies past the end of the ID space", name, i)
+		}
+		if !bucket.Prefix.Equals(start) {
+			t.Fatalf("%s: Bucket %d starts at %s, expected %s", name, i,
+				bucket.Prefix.AsString(), start.AsString())
+		}
+		if !maskID(bucket.Prefix, bucket.Depth).Equals(bucket.Prefix) {
+			t.Errorf("%s: Bucket %d has bits set past its depth", name, i)
+		}
+		if len(bucket.ContactList) > k {
+			t.Errorf("%s: Bucket %d holds %d contacts", name, i, len(bucket.ContactList))
+		}
+		for _, con := range bucket.ContactList {
+			if !bucket.Covers(con.NodeID) {
+				t.Errorf("%s: Bucket %d holds %s, which is out of its range", name, i, con.NodeID.AsString())
+			}
+		}
+		contacts += len(bucket.ContactList)
+
+		// the bucket this one was split off held our own ID, or was one
+		// that relaxed splitting allows to split
+		if bucket.Depth > 0 {
+			parent := bucket.Depth - 1
+			if bucket.Prefix.Xor(kad.NodeID).PrefixLen() < parent && !(relaxed > 1 && parent%relaxed != 0) {
+				t.Errorf("%s: Bucket %d at depth %d was split off a bucket without our ID", name, i, bucket.Depth)
+			}
+		}
+		start, more = rangeEnd(bucket)
+	}
+	if more {
+		t.Fatalf("%s: Buckets end at %s", name, start.AsString())
+	}
+	return contacts
+}
+
+func TestRoutingTree(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad := newMemoryNode(network, "")
+	defer kad.Close()
+	if len(kad.BucketList) != 1 || kad.BucketList[0].Depth != 0 {
+		t.Fatal("TestRoutingTree: Routing table does not start as a single bucket")
+	}
+	checkRoutingTree(t, "TestRoutingTree", kad)
+
+	for i := 0; i < 2000; i++ {
+		con := Contact{NodeID: NewRandomID(), Host: net.IPv4(192, 0, 2, 1), Port: uint16(i + 1)}
+		kad.UpdateContactInKBucket(&con)
+		if i%100 == 0 {
+			checkRoutingTree(t, "TestRoutingTree", kad)
+		}
+	}
+	checkRoutingTree(t, "TestRoutingTree", kad)
+
+	// about one bucket per bit of distance to the closest of 2000 nodes
+	kad.BucketMutexLock.Lock()
+	count := len(kad.BucketList)
+	kad.BucketMutexLock.Unlock()
+	if count < 5 || count > 20 {
+		t.Errorf("TestRoutingTree: Table has %d buckets", count)
+	}
+	bucket, _ := kad.FindKBucket(kad.NodeID)
+	if !bucket.Covers(kad.NodeID) || bucket.Depth != count-1 {
+		t.Error("TestRoutingTree: Our own bucket is not the deepest one")
+	}
+	for i := 0; i < 50; i++ {
+		id := NewRandomID()
+		if bucket, _ := kad.FindKBucket(id); !bucket.Covers(id) {
+			t.Fatal("TestRoutingTree: FindKBucket returned a bucket not covering the ID")
+		}
+	}
+}
+
+func TestRelaxedSplitting(t *testing.T) {
+	network := NewMemoryNetwork()
+	strict := newMemoryNode(network, "")
+	defer strict.Close()
+	config := DefaultConfig()
+	config.Transport = network.Transport()
+	config.SplitBits = 4
+	relaxed := NewKademliaWithConfig("", config)
+	defer relaxed.Close()
+
+	for i := 0; i < 2000; i++ {
+		con := Contact{NodeID: NewRandomID(), Host: net.IPv4(192, 0, 2, 1), Port: uint16(i + 1)}
+		strict.UpdateContactInKBucket(&con)
+		relaxed.UpdateContactInKBucket(&con)
+	}
+	kept := checkRoutingTree(t, "TestRelaxedSplitting", strict)
+	keptRelaxed := checkRoutingTree(t, "TestRelaxedSplitting", relaxed)
+	if keptRelaxed <= kept {
+		t.Errorf("TestRelaxedSplitting: Relaxed table kept %d contacts, strict one %d", keptRelaxed, kept)
+	}
+}
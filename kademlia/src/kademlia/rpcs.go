@@ -7,33 +7,47 @@ package kademlia
 import (
 	"fmt"
 	"net"
+	"time"
 )
 
 type KademliaCore struct {
 	kademlia *Kademlia
 }
 
-// Host identification.
+// Host identification. NodeID is the SHA-1 hash of PublicKey, an Ed25519
+// key the node signs its messages with; nodes that do not sign leave it
+// empty.
 type Contact struct {
-	NodeID ID
-	Host   net.IP
-	Port   uint16
+	NodeID    ID
+	Host      net.IP
+	Port      uint16
+	PublicKey []byte
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 // PING
 ///////////////////////////////////////////////////////////////////////////////
 type PingMessage struct {
-	Sender Contact
-	MsgID  ID
+	Sender    Contact
+	MsgID     ID
+	Signature []byte
 }
 
 type PongMessage struct {
-	MsgID  ID
-	Sender Contact
+	MsgID     ID
+	Sender    Contact
+	Signature []byte
 }
 
-func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) error {
+func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) (err error) {
+	defer func() {
+		kc.kademlia.metrics.rpcServed("Ping", err)
+	}()
+	// only a sender that signed the ping goes into the routing table
+	if err := kc.kademlia.verifyRequest(&ping, &ping.Sender); err != nil {
+		return err
+	}
+
 	// Specify the sender
 	// Update contact, etc
 	// sender is this node
@@ -44,7 +58,7 @@ func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) error {
 	// update contact in this kademlia kbucket
 	kc.kademlia.UpdateContactInKBucket(&ping.Sender)
 
-	return nil
+	return kc.kademlia.signReply(pong)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -55,64 +69,107 @@ type StoreRequest struct {
 	MsgID  ID
 	Key    ID
 	Value  []byte
+	// if not NoHash, Key is the hash of Value under this function, see
+	// content.go
+	Hash HashKind
+	// the node that originally published the value and when; the sender
+	// and the time of the request if left empty
+	Publisher ID
+	Published time.Time
+	// the value is a copy cached by a lookup, see Record.Cached
+	Cached    bool
+	Signature []byte
 }
 
 type StoreResult struct {
 	MsgID ID
 	Err   error
+	// key of the node that answered, and its signature
+	PublicKey []byte
+	Signature []byte
 }
 
-func (kc *KademliaCore) Store(req StoreRequest, res *StoreResult) error {
-	valueCopy := make([]byte, len(req.Value))
-	copy(valueCopy, req.Value)
-
-	kc.kademlia.TableMutexLock.Lock()
-	kc.kademlia.Table[CopyID(req.Key)] = valueCopy
-	kc.kademlia.TableMutexLock.Unlock()
+func (kc *KademliaCore) Store(req StoreRequest, res *StoreResult) (err error) {
+	defer func() {
+		kc.kademlia.metrics.rpcServed("Store", err)
+	}()
+	if err := kc.kademlia.verifyRequest(&req, &req.Sender); err != nil {
+		return err
+	}
+	if max := kc.kademlia.Config.MaxValueSize; len(req.Value) > max {
+		return fmt.Errorf("value of %d bytes is over the limit of %d", len(req.Value), max)
+	}
+	if err := verifyContent(req.Hash, req.Key, req.Value); err != nil {
+		return err
+	}
+	publisher, published := req.Publisher, req.Published
+	if publisher == (ID{}) {
+		publisher = req.Sender.NodeID
+	}
+	if published.IsZero() {
+		published = time.Now()
+	}
+	if published.After(time.Now().Add(maxClockSkew)) {
+		return fmt.Errorf("publish time %s is in the future", published.Format(time.RFC3339))
+	}
+	if err := kc.kademlia.putRecord(req.Key, req.Value, publisher, published, req.Cached); err != nil {
+		return err
+	}
 
 	res.MsgID = CopyID(req.MsgID)
 	res.Err = nil
+	res.PublicKey = kc.kademlia.SelfContact.PublicKey
 
 	// update contact in kbucket
 	kc.kademlia.UpdateContactInKBucket(&req.Sender)
 
-	return nil
+	return kc.kademlia.signReply(res)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 // FIND_NODE
 ///////////////////////////////////////////////////////////////////////////////
 type FindNodeRequest struct {
-	Sender Contact
-	MsgID  ID
-	NodeID ID
+	Sender    Contact
+	MsgID     ID
+	NodeID    ID
+	Signature []byte
 }
 
 type FindNodeResult struct {
-	MsgID ID
-	Nodes []Contact
-	Err   error
-}
-
-func (kc *KademliaCore) FindNode(req FindNodeRequest, res *FindNodeResult) error {
-	kc.kademlia.UpdateContacts(req.Sender)
+	MsgID     ID
+	Nodes     []Contact
+	Err       error
+	PublicKey []byte
+	Signature []byte
+}
+
+func (kc *KademliaCore) FindNode(req FindNodeRequest, res *FindNodeResult) (err error) {
+	defer func() {
+		kc.kademlia.metrics.rpcServed("FindNode", err)
+	}()
+	if err := kc.kademlia.verifyRequest(&req, &req.Sender); err != nil {
+		return err
+	}
 	res.MsgID = CopyID(req.MsgID)
-	res.Nodes = kc.kademlia.FindCloseContacts(req.NodeID)
+	res.Nodes = kc.kademlia.FindCloseContacts(req.NodeID, req.Sender.NodeID)
 	res.Err = nil
+	res.PublicKey = kc.kademlia.SelfContact.PublicKey
 
 	// update contact in kbucket
 	kc.kademlia.UpdateContactInKBucket(&req.Sender)
 
-	return nil
+	return kc.kademlia.signReply(res)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 // FIND_VALUE
 ///////////////////////////////////////////////////////////////////////////////
 type FindValueRequest struct {
-	Sender Contact
-	MsgID  ID
-	Key    ID
+	Sender    Contact
+	MsgID     ID
+	Key       ID
+	Signature []byte
 }
 
 // If Value is nil, it should be ignored, and Nodes means the same as in a
@@ -120,35 +177,41 @@ type FindValueRequest struct {
 type FindValueResult struct {
 	MsgID ID
 	Value []byte
-	Nodes []Contact
-	Err   error
-}
-
-func (kc *KademliaCore) FindValue(req FindValueRequest, res *FindValueResult) error {
-	res.MsgID = CopyID(req.MsgID)
-	kc.kademlia.TableMutexLock.Lock() // jwhang: Pretty sure you don't need a lock for reading values. Let me check OS slides.
-	val := kc.kademlia.Table[req.Key]
-	kc.kademlia.TableMutexLock.Unlock()
-	res.Nodes = kc.kademlia.FindCloseContacts(req.Sender.NodeID)
-	fmt.Println("LOL")
-	fmt.Println(len(res.Nodes))
-
-	if val == nil || len(val) == 0 {
-		fmt.Println("ERRORERROR")
-		res.Value = nil
-		err := new(NotFoundError)
-		err.msg = "Value is nil or is empty byte array"
-		res.Err = err
+	// who published Value and when, so that cached copies keep them
+	Publisher ID
+	Published time.Time
+	Nodes     []Contact
+	Err       error
+	PublicKey []byte
+	Signature []byte
+}
+
+func (kc *KademliaCore) FindValue(req FindValueRequest, res *FindValueResult) (err error) {
+	defer func() {
+		kc.kademlia.metrics.rpcServed("FindValue", err)
+	}()
+	if err := kc.kademlia.verifyRequest(&req, &req.Sender); err != nil {
 		return err
 	}
+	res.MsgID = CopyID(req.MsgID)
+	rec, ok := kc.kademlia.liveRecord(req.Key)
 
-	res.Value = val
+	if !ok {
+		// we don't have it, point the sender at nodes closer to the key
+		res.Value = nil
+		res.Nodes = kc.kademlia.FindCloseContacts(req.Key, req.Sender.NodeID)
+	} else {
+		res.Value = rec.Value
+		res.Publisher = rec.Publisher
+		res.Published = rec.Published
+	}
 	res.Err = nil
+	res.PublicKey = kc.kademlia.SelfContact.PublicKey
 
 	// update contact in kbucket
 	kc.kademlia.UpdateContactInKBucket(&req.Sender)
 
-	return nil
+	return kc.kademlia.signReply(res)
 }
 
 ///////////////////////////////////////////////////////////////////////////////
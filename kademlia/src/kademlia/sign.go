@@ -0,0 +1,144 @@
+package kademlia
+
+// Contains the signatures that authenticate RPC messages. A node's ID is the
+// SHA-1 hash of its Ed25519 public key, and every request and reply it sends
+// is signed with the matching private key over the binary encoding in
+// wire.go, so a message can only claim an ID whose key signed it.
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+)
+
+var (
+	errUnsigned     = errors.New("message is not signed")
+	errKeyMismatch  = errors.New("node ID does not match public key")
+	errBadSignature = errors.New("bad signature")
+	errWrongMsgID   = errors.New("reply MsgID does not match the request")
+)
+
+// Returns the ID of the node holding the private key for pub.
+func NodeIDFromPublicKey(pub ed25519.PublicKey) ID {
+	return ID(sha1.Sum(pub))
+}
+
+// Returns the Signature field of one of the RPC messages.
+func signatureOf(msg interface{}) *[]byte {
+	switch m := msg.(type) {
+	case *PingMessage:
+		return &m.Signature
+	case *PongMessage:
+		return &m.Signature
+	case *StoreRequest:
+		return &m.Signature
+	case *StoreResult:
+		return &m.Signature
+	case *FindNodeRequest:
+		return &m.Signature
+	case *FindNodeResult:
+		return &m.Signature
+	case *FindValueRequest:
+		return &m.Signature
+	case *FindValueResult:
+		return &m.Signature
+	}
+	return nil
+}
+
+// Returns the MsgID field of one of the RPC messages.
+func msgIDOf(msg interface{}) *ID {
+	switch m := msg.(type) {
+	case *PingMessage:
+		return &m.MsgID
+	case *PongMessage:
+		return &m.MsgID
+	case *StoreRequest:
+		return &m.MsgID
+	case *StoreResult:
+		return &m.MsgID
+	case *FindNodeRequest:
+		return &m.MsgID
+	case *FindNodeResult:
+		return &m.MsgID
+	case *FindValueRequest:
+		return &m.MsgID
+	case *FindValueResult:
+		return &m.MsgID
+	}
+	return nil
+}
+
+// Signs msg, which must be a pointer to one of the RPC messages, with key.
+func signMessage(key ed25519.PrivateKey, msg interface{}) error {
+	sig := signatureOf(msg)
+	if sig == nil {
+		return errors.New("message cannot be signed")
+	}
+	data, err := encodeMessage(msg, false)
+	if err != nil {
+		return err
+	}
+	*sig = ed25519.Sign(key, data)
+	return nil
+}
+
+// Checks that msg was signed with pub and that pub belongs to id.
+func verifyMessage(msg interface{}, id ID, pub []byte) error {
+	sig := signatureOf(msg)
+	if sig == nil || len(*sig) == 0 || len(pub) == 0 {
+		return errUnsigned
+	}
+	if len(pub) != ed25519.PublicKeySize || NodeIDFromPublicKey(pub) != id {
+		return errKeyMismatch
+	}
+	data, err := encodeMessage(msg, false)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, data, *sig) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// Checks a request against the contact it claims to come from, and that
+// contact's ID against the crypto puzzle.
+func (k *Kademlia) verifyRequest(msg interface{}, sender *Contact) error {
+	if err := verifyMessage(msg, sender.NodeID, sender.PublicKey); err != nil {
+		return err
+	}
+	return k.checkPuzzle(sender.NodeID)
+}
+
+// Checks a reply against the request it answers and the contact the request
+// was sent to. A pong is checked against the sender it names instead, since
+// pings go to addresses whose node may not be known yet.
+func (k *Kademlia) verifyReply(request interface{}, msg interface{}, contact *Contact) error {
+	reqID, msgID := msgIDOf(request), msgIDOf(msg)
+	if reqID == nil || msgID == nil || !msgID.Equals(*reqID) {
+		return errWrongMsgID
+	}
+	id, pub := contact.NodeID, []byte(nil)
+	switch m := msg.(type) {
+	case *PongMessage:
+		id, pub = m.Sender.NodeID, m.Sender.PublicKey
+	case *StoreResult:
+		pub = m.PublicKey
+	case *FindNodeResult:
+		pub = m.PublicKey
+	case *FindValueResult:
+		pub = m.PublicKey
+	default:
+		return errUnsigned
+	}
+	if err := verifyMessage(msg, id, pub); err != nil {
+		return err
+	}
+	return k.checkPuzzle(id)
+}
+
+// Signs a reply from this node.
+func (k *Kademlia) signReply(msg interface{}) error {
+	return signMessage(k.privateKey, msg)
+}
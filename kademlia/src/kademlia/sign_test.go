@@ -0,0 +1,126 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+)
+
+// Returns a contact for a node that is not running, and the key to sign its
+// requests with.
+func newTestSender(host net.IP, port uint16) (Contact, ed25519.PrivateKey) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	return Contact{NodeIDFromPublicKey(pub), host, port, pub}, priv
+}
+
+func TestSignedRPCs(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad1 := newMemoryNode(network, "")
+	kad2 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+	ctx := context.Background()
+
+	if !kad1.NodeID.Equals(NodeIDFromPublicKey(kad1.SelfContact.PublicKey)) {
+		t.Error("TestSignedRPCs: Node ID is not derived from the public key")
+	}
+	pong, err := kad1.Ping(ctx, kad2.SelfContact.Host, kad2.SelfContact.Port)
+	if err != nil || !bytes.Equal(pong.PublicKey, kad2.SelfContact.PublicKey) {
+		t.Fatal("TestSignedRPCs: Ping failed:", err)
+	}
+	contact, err := kad2.FindContact(kad1.NodeID)
+	if err != nil || !bytes.Equal(contact.PublicKey, kad1.SelfContact.PublicKey) {
+		t.Error("TestSignedRPCs: Contact was not added with its key")
+	}
+	key := NewRandomID()
+	if err := kad1.Store(ctx, &kad2.SelfContact, key, []byte("signed")); err != nil {
+		t.Fatal("TestSignedRPCs: Store failed:", err)
+	}
+	value, _, err := kad1.FindValue(ctx, &kad2.SelfContact, key)
+	if err != nil || string(value) != "signed" {
+		t.Error("TestSignedRPCs: FindValue failed:", err)
+	}
+
+	// a node answering in the name of another is not believed
+	impostor := kad2.SelfContact
+	impostor.NodeID = kad1.NodeID
+	if _, err := kad1.FindNode(ctx, &impostor, NewRandomID()); err == nil {
+		t.Error("TestSignedRPCs: Reply from the wrong node was accepted")
+	}
+}
+
+func TestForgedSenderIsRejected(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad := newMemoryNode(network, "")
+	victim := newMemoryNode(network, "")
+	defer kad.Close()
+	defer victim.Close()
+	core := &KademliaCore{kad}
+	attacker, priv := newTestSender(victim.SelfContact.Host, 9999)
+
+	// claims an ID of its choosing with its own key
+	forged := attacker
+	forged.NodeID = NewRandomID()
+	ping := PingMessage{Sender: forged, MsgID: NewRandomID()}
+	signMessage(priv, &ping)
+	if err := core.Ping(ping, new(PongMessage)); err == nil {
+		t.Error("TestForgedSenderIsRejected: ID not matching the key was accepted")
+	}
+	if _, err := kad.FindContact(forged.NodeID); err == nil {
+		t.Error("TestForgedSenderIsRejected: Forged contact was added")
+	}
+
+	// claims the victim's ID and key, but cannot sign for them
+	ping = PingMessage{Sender: victim.SelfContact, MsgID: NewRandomID()}
+	ping.Sender.Port = 9999
+	signMessage(priv, &ping)
+	if err := core.Ping(ping, new(PongMessage)); err == nil {
+		t.Error("TestForgedSenderIsRejected: Bad signature was accepted")
+	}
+	if _, err := kad.FindContact(victim.NodeID); err == nil {
+		t.Error("TestForgedSenderIsRejected: Victim was added with the attacker's address")
+	}
+
+	ping = PingMessage{Sender: attacker, MsgID: NewRandomID()}
+	if err := core.Ping(ping, new(PongMessage)); err == nil {
+		t.Error("TestForgedSenderIsRejected: Unsigned ping was accepted")
+	}
+
+	// a STORE altered after signing is refused
+	store := StoreRequest{Sender: attacker, MsgID: NewRandomID(), Key: NewRandomID(), Value: []byte("good")}
+	signMessage(priv, &store)
+	store.Value = []byte("evil")
+	if err := core.Store(store, new(StoreResult)); err == nil {
+		t.Error("TestForgedSenderIsRejected: Tampered STORE was accepted")
+	}
+	if kad.getRecord(store.Key) != nil {
+		t.Error("TestForgedSenderIsRejected: Tampered value was stored")
+	}
+	store.Value = []byte("good")
+	if err := core.Store(store, new(StoreResult)); err != nil {
+		t.Error("TestForgedSenderIsRejected: Signed STORE was refused:", err)
+	}
+}
+
+func TestReplyMsgID(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad1 := newMemoryNode(network, "")
+	kad2 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+
+	// a signed reply from the right node, but to some other request
+	request := &FindNodeRequest{Sender: kad1.SelfContact, MsgID: NewRandomID(), NodeID: NewRandomID()}
+	reply := &FindNodeResult{MsgID: NewRandomID(), PublicKey: kad2.SelfContact.PublicKey}
+	kad2.signReply(reply)
+	if err := kad1.verifyReply(request, reply, &kad2.SelfContact); err == nil {
+		t.Error("TestReplyMsgID: Reply to another request was accepted")
+	}
+	reply.MsgID = request.MsgID
+	kad2.signReply(reply)
+	if err := kad1.verifyReply(request, reply, &kad2.SelfContact); err != nil {
+		t.Error("TestReplyMsgID: Reply to the request was refused:", err)
+	}
+}
@@ -0,0 +1,196 @@
+package kademlia
+
+// Contains the status page of a node, served as HTML at /status and as JSON
+// at /status.json.
+
+import (
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A snapshot of a node for the status page.
+type NodeStatus struct {
+	NodeID  string
+	Address string
+	// non-empty k-buckets only, in routing table order
+	Buckets []BucketStatus
+	// every record held, sorted by key
+	Values []ValueStatus
+	// the last few lookups, most recent first
+	Lookups []LookupStatus
+}
+
+type BucketStatus struct {
+	Index    int
+	Prefix   string
+	Depth    int
+	Contacts []ContactStatus
+}
+
+type ContactStatus struct {
+	NodeID  string
+	Address string
+	// zero if the contact was not heard from while in the bucket
+	LastSeen time.Time
+	// of the last RPC made to the contact, zero if there was none
+	RTT      time.Duration
+	Failures int
+}
+
+type ValueStatus struct {
+	Key     string
+	Size    int
+	Expires time.Time
+}
+
+// A lookup this node ran.
+type LookupStatus struct {
+	Target   string
+	Started  time.Time
+	Duration time.Duration
+	// rounds of queries on the deepest path
+	Hops  int
+	Paths int
+	Found bool
+	// why the lookup ended early, if it did
+	Err string
+	// IDs of the nodes queried, in the order they were asked
+	Queried []string
+}
+
+func hostPort(host net.IP, port uint16) string {
+	return net.JoinHostPort(host.String(), strconv.Itoa(int(port)))
+}
+
+// Takes a snapshot of the node for the status page.
+func (k *Kademlia) Status() NodeStatus {
+	status := NodeStatus{
+		NodeID:  k.NodeID.AsString(),
+		Address: hostPort(k.SelfContact.Host, k.SelfContact.Port),
+		Buckets: make([]BucketStatus, 0),
+		Values:  make([]ValueStatus, 0),
+		Lookups: make([]LookupStatus, 0),
+	}
+
+	k.BucketMutexLock.Lock()
+	for i, bucket := range k.BucketList {
+		if len(bucket.ContactList) == 0 {
+			continue
+		}
+		b := BucketStatus{
+			Index:    i,
+			Prefix:   bucket.Prefix.AsString(),
+			Depth:    bucket.Depth,
+			Contacts: make([]ContactStatus, 0, len(bucket.ContactList)),
+		}
+		for _, con := range bucket.ContactList {
+			b.Contacts = append(b.Contacts, ContactStatus{
+				NodeID:   con.NodeID.AsString(),
+				Address:  hostPort(con.Host, con.Port),
+				LastSeen: bucket.LastSeen[con.NodeID],
+				RTT:      bucket.RTT[con.NodeID],
+				Failures: bucket.Failures[con.NodeID],
+			})
+		}
+		status.Buckets = append(status.Buckets, b)
+	}
+	k.BucketMutexLock.Unlock()
+
+	k.Table.Iterate(func(key ID, rec Record) bool {
+		status.Values = append(status.Values, ValueStatus{
+			Key:     key.AsString(),
+			Size:    len(rec.Value),
+			Expires: rec.Expires,
+		})
+		return true
+	})
+	sort.Slice(status.Values, func(a, b int) bool {
+		return status.Values[a].Key < status.Values[b].Key
+	})
+
+	k.metrics.mutex.Lock()
+	for i := len(k.metrics.lookups) - 1; i >= 0; i-- {
+		status.Lookups = append(status.Lookups, k.metrics.lookups[i])
+	}
+	k.metrics.mutex.Unlock()
+	return status
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Round(time.Millisecond).String() + " ago"
+	},
+	"when": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Kademlia node {{.NodeID}}</title></head>
+<body>
+<h1>Node {{.NodeID}}</h1>
+<p>Listening on {{.Address}}</p>
+
+<h2>Routing table</h2>
+{{range .Buckets}}
+<h3>Bucket {{.Index}}, depth {{.Depth}}, prefix {{.Prefix}}</h3>
+<table border="1">
+<tr><th>Node ID</th><th>Address</th><th>Last seen</th><th>RTT</th><th>Failures</th></tr>
+{{range .Contacts}}<tr><td>{{.NodeID}}</td><td>{{.Address}}</td><td>{{ago .LastSeen}}</td><td>{{if .RTT}}{{.RTT}}{{else}}-{{end}}</td><td>{{.Failures}}</td></tr>
+{{end}}</table>
+{{else}}
+<p>No contacts.</p>
+{{end}}
+
+<h2>Values</h2>
+{{if .Values}}<table border="1">
+<tr><th>Key</th><th>Size</th><th>Expires</th></tr>
+{{range .Values}}<tr><td>{{.Key}}</td><td>{{.Size}}</td><td>{{when .Expires}}</td></tr>
+{{end}}</table>
+{{else}}
+<p>No values.</p>
+{{end}}
+
+<h2>Recent lookups</h2>
+{{range .Lookups}}
+<h3>{{.Target}}</h3>
+<p>Started {{ago .Started}}, took {{.Duration}} over {{.Hops}} hops on {{.Paths}} path(s).
+{{if .Found}}Found the value.{{end}} {{if .Err}}Failed: {{.Err}}{{end}}</p>
+<p>Queried: {{range .Queried}}{{.}} {{else}}nobody{{end}}</p>
+{{else}}
+<p>No lookups yet.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// Returns a handler serving the status page as HTML. With the default
+// HTTPTransport it is already served at /status on the node's listener.
+func (k *Kademlia) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, k.Status()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Returns a handler serving the same data as StatusHandler as JSON, for
+// scripts. Durations are in nanoseconds. With the default HTTPTransport it
+// is already served at /status.json on the node's listener.
+func (k *Kademlia) StatusJSONHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(k.Status())
+	})
+}
@@ -0,0 +1,65 @@
+package kademlia
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusPage(t *testing.T) {
+	network := NewMemoryNetwork()
+	kad1 := newMemoryNode(network, "")
+	kad2 := newMemoryNode(network, "")
+	defer kad1.Close()
+	defer kad2.Close()
+	ctx := context.Background()
+
+	// the first ping adds node 2, the second one is timed
+	for i := 0; i < 2; i++ {
+		if _, err := kad1.Ping(ctx, kad2.SelfContact.Host, kad2.SelfContact.Port); err != nil {
+			t.Fatal("TestStatusPage: Ping failed:", err)
+		}
+	}
+	key := NewRandomID()
+	if _, err := kad1.IterativeStore(ctx, key, []byte("status")); err != nil {
+		t.Fatal("TestStatusPage: IterativeStore failed:", err)
+	}
+
+	resp := httptest.NewRecorder()
+	kad1.StatusJSONHandler().ServeHTTP(resp, httptest.NewRequest("GET", "/status.json", nil))
+	var status NodeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal("TestStatusPage: Decoding failed:", err)
+	}
+	if status.NodeID != kad1.NodeID.AsString() || status.Address != hostPort(kad1.SelfContact.Host, kad1.SelfContact.Port) {
+		t.Error("TestStatusPage: Wrong node", status.NodeID, status.Address)
+	}
+	if len(status.Buckets) != 1 || len(status.Buckets[0].Contacts) != 1 {
+		t.Fatal("TestStatusPage: Expected one bucket with one contact")
+	}
+	con := status.Buckets[0].Contacts[0]
+	if con.NodeID != kad2.NodeID.AsString() || con.LastSeen.IsZero() || con.RTT <= 0 {
+		t.Errorf("TestStatusPage: Contact reported as %+v", con)
+	}
+	if len(status.Lookups) != 1 || status.Lookups[0].Target != key.AsString() ||
+		len(status.Lookups[0].Queried) != 1 || status.Lookups[0].Queried[0] != kad2.NodeID.AsString() {
+		t.Errorf("TestStatusPage: Lookups reported as %+v", status.Lookups)
+	}
+
+	values := kad2.Status().Values
+	if len(values) != 1 || values[0].Key != key.AsString() || values[0].Size != 6 || values[0].Expires.IsZero() {
+		t.Errorf("TestStatusPage: Values reported as %+v", values)
+	}
+
+	resp = httptest.NewRecorder()
+	kad1.StatusHandler().ServeHTTP(resp, httptest.NewRequest("GET", "/status", nil))
+	page := resp.Body.String()
+	address := hostPort(kad2.SelfContact.Host, kad2.SelfContact.Port)
+	for _, expected := range []string{kad1.NodeID.AsString(), kad2.NodeID.AsString(), key.AsString(), address} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("TestStatusPage: Page does not mention %s", expected)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package kademlia
+
+// Contains the interface values are stored through, and an in-memory
+// implementation of it.
+
+import (
+	"sync"
+)
+
+// Storage backend for the records a node holds. Implementations must be safe
+// for concurrent use.
+type Store interface {
+	// Returns the record under key, and false if there is none.
+	Get(key ID) (Record, bool, error)
+	// Saves rec under key, replacing any record already there.
+	Put(key ID, rec Record) error
+	// Removes the record under key. Deleting a missing key is not an error.
+	Delete(key ID) error
+	// Calls fn for every record until it returns false. fn must not call
+	// back into the store.
+	Iterate(fn func(key ID, rec Record) bool) error
+	// Returns the number of records held.
+	Size() int
+	// Releases any resources held by the store.
+	Close() error
+}
+
+// Store that keeps records in a map. Its contents are lost when the node
+// stops.
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	records map[ID]Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := new(MemoryStore)
+	s.records = make(map[ID]Record)
+	return s
+}
+
+func (s *MemoryStore) Get(key ID) (Record, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	rec, ok := s.records[key]
+	return rec, ok, nil
+}
+
+func (s *MemoryStore) Put(key ID, rec Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records[CopyID(key)] = rec
+	return nil
+}
+
+func (s *MemoryStore) Delete(key ID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func (s *MemoryStore) Iterate(fn func(key ID, rec Record) bool) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for key, rec := range s.records {
+		if !fn(key, rec) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Size() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.records)
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,245 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Runs the checks every Store implementation has to pass.
+func checkStore(t *testing.T, name string, s Store) {
+	key := NewRandomID()
+	rec := Record{
+		Value:     []byte("value"),
+		Publisher: NewRandomID(),
+		Published: time.Now(),
+		Expires:   time.Now().Add(time.Hour),
+	}
+	if _, ok, err := s.Get(key); ok || err != nil {
+		t.Error(name + ": Empty store returned a record")
+	}
+	if err := s.Put(key, rec); err != nil {
+		t.Fatal(name+": Put failed:", err)
+	}
+	got, ok, err := s.Get(key)
+	if !ok || err != nil || !bytes.Equal(got.Value, rec.Value) || !got.Publisher.Equals(rec.Publisher) {
+		t.Error(name + ": Get did not return the stored record")
+	}
+	other := NewRandomID()
+	s.Put(other, rec)
+	if s.Size() != 2 {
+		t.Error(name + ": Size is wrong")
+	}
+	seen := 0
+	s.Iterate(func(key ID, rec Record) bool {
+		seen++
+		return false
+	})
+	if seen != 1 {
+		t.Error(name + ": Iterate did not stop when asked to")
+	}
+	if err := s.Delete(key); err != nil {
+		t.Error(name+": Delete failed:", err)
+	}
+	if err := s.Delete(key); err != nil {
+		t.Error(name+": Deleting a missing key failed:", err)
+	}
+	if _, ok, _ := s.Get(key); ok || s.Size() != 1 {
+		t.Error(name + ": Deleted record is still there")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	checkStore(t, "TestMemoryStore", NewMemoryStore())
+}
+
+func TestDiskStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.log")
+
+	s, err := OpenDiskStore(path)
+	if err != nil {
+		t.Fatal("TestDiskStore: OpenDiskStore failed:", err)
+	}
+	checkStore(t, "TestDiskStore", s)
+	key := NewRandomID()
+	published := time.Now().Add(-time.Minute)
+	s.Put(key, Record{Value: []byte("kept"), Publisher: key, Published: published, Cached: true})
+	s.Close()
+
+	// a write torn by a crash is dropped when the log is replayed
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0660)
+	f.Write(encodeEntry(opPut, NewRandomID(), Record{Value: []byte("torn")})[:20])
+	f.Close()
+
+	s, err = OpenDiskStore(path)
+	if err != nil {
+		t.Fatal("TestDiskStore: Reopening failed:", err)
+	}
+	rec, ok, _ := s.Get(key)
+	if !ok || !bytes.Equal(rec.Value, []byte("kept")) || !rec.Published.Equal(published) || !rec.Expires.IsZero() || !rec.Cached {
+		t.Error("TestDiskStore: Record did not survive reopening")
+	}
+	if s.Size() != 2 {
+		t.Error("TestDiskStore: Reopened store has the wrong size")
+	}
+
+	// the log can still be appended to after the torn entry was cut off
+	for i := 0; i < minCompactEntries; i++ {
+		s.Put(key, Record{Value: []byte("overwritten")})
+	}
+	if s.entries >= minCompactEntries {
+		t.Error("TestDiskStore: Log was not compacted")
+	}
+	s.Close()
+	s, err = OpenDiskStore(path)
+	if err != nil {
+		t.Fatal("TestDiskStore: Reopening after compaction failed:", err)
+	}
+	defer s.Close()
+	if rec, _, _ := s.Get(key); !bytes.Equal(rec.Value, []byte("overwritten")) || s.Size() != 2 {
+		t.Error("TestDiskStore: Compacted log lost records")
+	}
+}
+
+// The entry that triggers a compaction has to be in the compacted log.
+func TestDiskStoreCompactionKeepsLastChange(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.log")
+
+	s, err := OpenDiskStore(path)
+	if err != nil {
+		t.Fatal("TestDiskStoreCompactionKeepsLastChange: OpenDiskStore failed:", err)
+	}
+	old, added := NewRandomID(), NewRandomID()
+	for i := 0; i < minCompactEntries-1; i++ {
+		s.Put(old, Record{Value: []byte("overwritten")})
+	}
+	s.Put(added, Record{Value: []byte("added")})
+	if s.entries >= minCompactEntries {
+		t.Fatal("TestDiskStoreCompactionKeepsLastChange: Put did not compact the log")
+	}
+	s.Close()
+	s, err = OpenDiskStore(path)
+	if err != nil {
+		t.Fatal("TestDiskStoreCompactionKeepsLastChange: Reopening failed:", err)
+	}
+	if rec, ok, _ := s.Get(added); !ok || !bytes.Equal(rec.Value, []byte("added")) {
+		t.Error("TestDiskStoreCompactionKeepsLastChange: Put that compacted the log was lost")
+	}
+
+	for i := 0; i < minCompactEntries-3; i++ {
+		s.Put(old, Record{Value: []byte("overwritten")})
+	}
+	s.Delete(added)
+	if s.entries >= minCompactEntries {
+		t.Fatal("TestDiskStoreCompactionKeepsLastChange: Delete did not compact the log")
+	}
+	s.Close()
+	s, err = OpenDiskStore(path)
+	if err != nil {
+		t.Fatal("TestDiskStoreCompactionKeepsLastChange: Reopening failed:", err)
+	}
+	defer s.Close()
+	if _, ok, _ := s.Get(added); ok {
+		t.Error("TestDiskStoreCompactionKeepsLastChange: Delete that compacted the log was undone")
+	}
+	if s.Size() != 1 {
+		t.Error("TestDiskStoreCompactionKeepsLastChange: Reopened store has the wrong size")
+	}
+}
+
+func TestDiskStoreFailedWrite(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.log")
+
+	s, err := OpenDiskStore(path)
+	if err != nil {
+		t.Fatal("TestDiskStoreFailedWrite: OpenDiskStore failed:", err)
+	}
+	first, second := NewRandomID(), NewRandomID()
+	s.Put(first, Record{Value: []byte("first")})
+
+	// a write that got only partway is cut off, and the next entry is not
+	// lost behind it
+	end, _ := s.file.Seek(0, io.SeekCurrent)
+	s.file.Write(encodeEntry(opPut, NewRandomID(), Record{Value: []byte("torn")})[:20])
+	s.rollback(end)
+	if err := s.Put(second, Record{Value: []byte("second")}); err != nil {
+		t.Fatal("TestDiskStoreFailedWrite: Put after a rollback failed:", err)
+	}
+	s.Close()
+	s, err = OpenDiskStore(path)
+	if err != nil {
+		t.Fatal("TestDiskStoreFailedWrite: Reopening failed:", err)
+	}
+	if _, ok, _ := s.Get(second); !ok || s.Size() != 2 {
+		t.Error("TestDiskStoreFailedWrite: Entry after the rollback was lost")
+	}
+
+	// a write that cannot be undone leaves the store refusing changes
+	file := s.file
+	s.file, _ = os.Open(path)
+	if err := s.Put(NewRandomID(), Record{Value: []byte("refused")}); err == nil {
+		t.Error("TestDiskStoreFailedWrite: Put to a read-only log succeeded")
+	}
+	s.file.Close()
+	s.file = file
+	if err := s.Put(NewRandomID(), Record{Value: []byte("refused")}); err == nil {
+		t.Error("TestDiskStoreFailedWrite: Failed store accepted a Put")
+	}
+	if _, ok, _ := s.Get(first); !ok {
+		t.Error("TestDiskStoreFailedWrite: Failed store lost its records")
+	}
+	s.Close()
+}
+
+func TestNodeRestartKeepsValues(t *testing.T) {
+	dir, err := os.MkdirTemp("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.log")
+
+	open := func() *Kademlia {
+		store, err := OpenDiskStore(path)
+		if err != nil {
+			t.Fatal("TestNodeRestartKeepsValues: OpenDiskStore failed:", err)
+		}
+		config := DefaultConfig()
+		config.Store = store
+		return NewKademliaWithConfig("localhost:9047", config)
+	}
+	kad1 := open()
+	kad2 := NewKademlia("localhost:9048")
+	defer kad2.Close()
+
+	key := NewRandomID()
+	if err := kad2.Store(context.Background(), &kad1.SelfContact, key, []byte("durable")); err != nil {
+		t.Fatal("TestNodeRestartKeepsValues: Store failed:", err)
+	}
+	kad1.Close()
+
+	kad1 = open()
+	defer kad1.Close()
+	if val, err := kad1.LocalValue(key); err != nil || !bytes.Equal(val, []byte("durable")) {
+		t.Error("TestNodeRestartKeepsValues: Value was lost on restart")
+	}
+}
@@ -0,0 +1,179 @@
+package kademlia
+
+// Contains the interface RPCs are sent and served through, and its default
+// implementation on top of net/rpc over HTTP.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Carries RPCs between nodes. A node binds an address with Listen, serves
+// its KademliaCore there once Serve is called, and reaches other nodes
+// through Call. Call returns an rpc.ServerError when
+// the other node answered with an error, and a context error if ctx ended
+// first.
+type Transport interface {
+	// Binds laddr. Returns the address other nodes can reach it on.
+	Listen(laddr string) (net.IP, uint16, error)
+	// Starts serving core on the address bound by Listen.
+	Serve(core *KademliaCore)
+	// Calls method, such as "KademliaCore.Ping", on contact.
+	Call(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) error
+	// Stops serving and releases any connections.
+	Close() error
+}
+
+// Transport that serves net/rpc over HTTP on a TCP listener, at the path
+// rpc.DefaultRPCPath followed by the port. Outbound connections are pooled.
+type HTTPTransport struct {
+	pool     *ClientPool
+	mux      *http.ServeMux
+	listener net.Listener
+	port     uint16
+	// connections accepted by the listener; net/rpc hijacks them from the
+	// HTTP server, so they have to be closed by hand
+	connMutex sync.Mutex
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+// A connection accepted by an HTTPTransport, which forgets it on Close.
+type servedConn struct {
+	net.Conn
+	t    *HTTPTransport
+	once sync.Once
+}
+
+func (c *servedConn) Close() error {
+	c.once.Do(func() {
+		c.t.connMutex.Lock()
+		delete(c.t.conns, c.Conn)
+		c.t.connMutex.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// Hands the connections of the listener it wraps to the HTTP server, keeping
+// track of them in the transport.
+type servedListener struct {
+	net.Listener
+	t *HTTPTransport
+}
+
+func (l servedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.t.connMutex.Lock()
+	defer l.t.connMutex.Unlock()
+	if l.t.closed {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	l.t.conns[conn] = true
+	return &servedConn{Conn: conn, t: l.t}, nil
+}
+
+// Creates an HTTP transport whose pool keeps up to maxIdle connections open
+// for at most idleTimeout.
+func NewHTTPTransport(maxIdle int, idleTimeout time.Duration) *HTTPTransport {
+	t := new(HTTPTransport)
+	t.pool = NewClientPool(maxIdle, idleTimeout)
+	t.mux = http.NewServeMux()
+	t.conns = make(map[net.Conn]bool)
+	return t
+}
+
+func (t *HTTPTransport) Listen(laddr string) (net.IP, uint16, error) {
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	host, port, err := ResolveAddress(l.Addr().String())
+	if err != nil {
+		l.Close()
+		return nil, 0, err
+	}
+
+	t.listener = l
+	t.port = port
+	return host, port, nil
+}
+
+func (t *HTTPTransport) Serve(core *KademliaCore) {
+	s := rpc.NewServer()
+	s.Register(core)
+	// a unique RPC path for this instance of Kademlia
+	t.mux.Handle(rpc.DefaultRPCPath+strconv.Itoa(int(t.port)), s)
+	go http.Serve(servedListener{t.listener, t}, t.mux)
+}
+
+// Serves handler for pattern on the same listener as the RPCs.
+func (t *HTTPTransport) Handle(pattern string, handler http.Handler) {
+	t.mux.Handle(pattern, handler)
+}
+
+// Makes a call on client and waits for the reply until ctx is done.
+func waitForCall(ctx context.Context, client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Makes the call over a pooled connection.
+func (t *HTTPTransport) Call(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) error {
+	client, err := t.pool.Get(ctx, contact)
+	if err != nil {
+		return err
+	}
+
+	err = waitForCall(ctx, client, method, args, reply)
+	if err == rpc.ErrShutdown {
+		// the other side closed the pooled connection, try a fresh one
+		t.pool.Discard(client)
+		client, err = t.pool.Dial(ctx, contact)
+		if err != nil {
+			return err
+		}
+		err = waitForCall(ctx, client, method, args, reply)
+	}
+
+	var serverErr rpc.ServerError
+	if err == nil || errors.As(err, &serverErr) {
+		// the connection itself is fine
+		t.pool.Put(contact, client)
+	} else {
+		// closing the client also abandons the call still in flight
+		t.pool.Discard(client)
+	}
+	return err
+}
+
+// Stops the listener and closes every connection, served or pooled, so that
+// peers holding a connection to this node cannot reach it either.
+func (t *HTTPTransport) Close() error {
+	t.pool.Close()
+	t.connMutex.Lock()
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.conns = make(map[net.Conn]bool)
+	t.connMutex.Unlock()
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Close()
+}
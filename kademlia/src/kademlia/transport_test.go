@@ -0,0 +1,27 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+)
+
+func TestHTTPTransportClose(t *testing.T) {
+	kad1 := NewKademlia("localhost:0")
+	kad2 := NewKademlia("localhost:0")
+	defer kad1.Close()
+	// closed again below, but not if the test fails before that
+	defer kad2.Close()
+	ctx := context.Background()
+
+	// leaves a pooled connection from node 1 to node 2
+	if _, err := kad1.Ping(ctx, kad2.SelfContact.Host, kad2.SelfContact.Port); err != nil {
+		t.Fatal("TestHTTPTransportClose: Ping failed:", err)
+	}
+	kad2.Close()
+	if _, err := kad1.Ping(ctx, kad2.SelfContact.Host, kad2.SelfContact.Port); err == nil {
+		t.Error("TestHTTPTransportClose: Closed node still answers over a pooled connection")
+	}
+	if err := kad1.Store(ctx, &kad2.SelfContact, NewRandomID(), []byte("late")); err == nil {
+		t.Error("TestHTTPTransportClose: Closed node still takes STOREs")
+	}
+}
@@ -0,0 +1,404 @@
+package kademlia
+
+// Contains a Transport that sends RPCs as single UDP datagrams, falling back
+// to TCP for messages too large for one.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// datagrams are kept small enough to never be fragmented by IP
+	maxDatagramSize = 1232
+	// limit on messages sent over the TCP fallback
+	maxFrameSize = 64 << 20
+	// how long an idle TCP fallback connection is kept open by the server
+	tcpIdleTimeout = 30 * time.Second
+	// the client lets go of its idle connections well before the server does
+	streamIdleTimeout = tcpIdleTimeout / 2
+	maxIdleStreams    = 16
+
+	defaultRetransmitInterval = 250 * time.Millisecond
+)
+
+// Transport that sends each request and reply as one UDP datagram in the
+// encoding described in wire.go. Replies are matched to requests by MsgID. A
+// request that gets no reply is sent again, waiting twice as long each time,
+// until the context passed to Call ends. Messages larger than a datagram,
+// such as STOREs of large values, go over a TCP connection to the same port
+// instead, as length-prefixed frames. Those connections are kept open for
+// the next large message to the same address, like ClientPool does.
+type UDPTransport struct {
+	retransmit time.Duration
+	core       *KademliaCore
+	conn       *net.UDPConn
+	tcp        net.Listener
+	mutex      sync.Mutex
+	pending    map[ID]chan []byte
+	streams    map[string][]idleStream
+	numStreams int
+	closed     chan bool
+	closeOnce  sync.Once
+}
+
+type idleStream struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// Creates a UDP transport that first retransmits a request after
+// retransmit, or after 250ms if it is 0.
+func NewUDPTransport(retransmit time.Duration) *UDPTransport {
+	if retransmit == 0 {
+		retransmit = defaultRetransmitInterval
+	}
+	t := new(UDPTransport)
+	t.retransmit = retransmit
+	t.pending = make(map[ID]chan []byte)
+	t.streams = make(map[string][]idleStream)
+	t.closed = make(chan bool)
+	go t.reapStreams()
+	return t
+}
+
+func (t *UDPTransport) Listen(laddr string) (net.IP, uint16, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	host, port, err := ResolveAddress(conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	// large messages arrive over TCP on the same port
+	hostname, _, _ := net.SplitHostPort(laddr)
+	tcp, err := net.Listen("tcp", net.JoinHostPort(hostname, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+
+	t.conn = conn
+	t.tcp = tcp
+	return host, port, nil
+}
+
+func (t *UDPTransport) Serve(core *KademliaCore) {
+	t.core = core
+	go t.readLoop()
+	go t.acceptLoop()
+}
+
+func isRequest(typ byte) bool {
+	return typ == msgPing || typ == msgStore || typ == msgFindNode || typ == msgFindValue
+}
+
+// Serves requests and hands replies to the calls waiting for them.
+func (t *UDPTransport) readLoop() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-t.closed:
+				return
+			default:
+				continue
+			}
+		}
+		msg := append([]byte(nil), buf[:n]...)
+		typ, msgID, _, err := readHeader(msg)
+		if err != nil {
+			continue
+		}
+		if isRequest(typ) {
+			go t.serveDatagram(msg, addr)
+			continue
+		}
+		t.mutex.Lock()
+		waiting := t.pending[msgID]
+		t.mutex.Unlock()
+		if waiting != nil {
+			select {
+			case waiting <- msg:
+			default:
+				// a reply to a retransmission, the first one is enough
+			}
+		}
+	}
+}
+
+func (t *UDPTransport) serveDatagram(msg []byte, addr *net.UDPAddr) {
+	reply, err := handleRequest(t.core, msg)
+	if err != nil {
+		return
+	}
+	if len(reply) > maxDatagramSize {
+		_, msgID, _, _ := readHeader(msg)
+		reply = newWireWriter(msgTooLarge, msgID).buf
+	}
+	t.conn.WriteToUDP(reply, addr)
+}
+
+func (t *UDPTransport) acceptLoop() {
+	for {
+		conn, err := t.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go t.serveStream(conn)
+	}
+}
+
+// Serves requests over a TCP connection until it is closed or goes idle.
+func (t *UDPTransport) serveStream(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		msg, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		reply, err := handleRequest(t.core, msg)
+		if err != nil {
+			return
+		}
+		if err := writeFrame(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func writeFrame(w io.Writer, msg []byte) error {
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(msg)), uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrameSize {
+		return nil, errors.New("frame too large")
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func (t *UDPTransport) Call(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) error {
+	msg, msgID, err := encodeRequest(method, args)
+	if err != nil {
+		return err
+	}
+	if len(msg) > maxDatagramSize {
+		return t.callStream(ctx, contact, msg, reply)
+	}
+
+	waiting := make(chan []byte, 1)
+	t.mutex.Lock()
+	t.pending[msgID] = waiting
+	t.mutex.Unlock()
+	defer func() {
+		t.mutex.Lock()
+		delete(t.pending, msgID)
+		t.mutex.Unlock()
+	}()
+
+	addr := &net.UDPAddr{IP: contact.Host, Port: int(contact.Port)}
+	interval := t.retransmit
+	for {
+		if _, err := t.conn.WriteToUDP(msg, addr); err != nil {
+			return err
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case resp := <-waiting:
+			timer.Stop()
+			tooLarge, err := decodeReply(resp, reply)
+			if tooLarge {
+				return t.callStream(ctx, contact, msg, reply)
+			}
+			return err
+		case <-timer.C:
+			interval *= 2
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-t.closed:
+			timer.Stop()
+			return errors.New("transport is closed")
+		}
+	}
+}
+
+// Makes the call over a TCP connection, reusing an idle one to the same
+// address if there is one.
+func (t *UDPTransport) callStream(ctx context.Context, contact *Contact, msg []byte, reply interface{}) error {
+	address := net.JoinHostPort(contact.Host.String(), strconv.Itoa(int(contact.Port)))
+	conn := t.getStream(address)
+	reused := conn != nil
+	if !reused {
+		var err error
+		if conn, err = dialStream(ctx, address); err != nil {
+			return err
+		}
+	}
+	resp, err := exchange(ctx, conn, msg)
+	if err != nil && reused && ctx.Err() == nil {
+		// the server may have closed the idle connection, try a fresh one
+		conn.Close()
+		if conn, err = dialStream(ctx, address); err != nil {
+			return err
+		}
+		resp, err = exchange(ctx, conn, msg)
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	t.putStream(address, conn)
+
+	tooLarge, err := decodeReply(resp, reply)
+	if tooLarge {
+		// there is nowhere else to get it from
+		return errMalformed
+	}
+	return err
+}
+
+func dialStream(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// Sends msg over conn and reads the reply. If ctx ends first, the exchange
+// is cut short and conn is left unusable.
+func exchange(ctx context.Context, conn net.Conn, msg []byte) ([]byte, error) {
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	err := writeFrame(conn, msg)
+	var resp []byte
+	if err == nil {
+		resp, err = readFrame(conn)
+	}
+	if !stop() && err == nil {
+		// the deadline was set, whether or not it was hit in time
+		err = ctx.Err()
+	}
+	return resp, err
+}
+
+// Takes an idle connection to address out of the pool, or returns nil if
+// there is none.
+func (t *UDPTransport) getStream(address string) net.Conn {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	streams := t.streams[address]
+	if len(streams) == 0 {
+		return nil
+	}
+	// most recently used first, it is the least likely to be stale
+	s := streams[len(streams)-1]
+	t.streams[address] = streams[:len(streams)-1]
+	if len(t.streams[address]) == 0 {
+		delete(t.streams, address)
+	}
+	t.numStreams -= 1
+	return s.conn
+}
+
+// Hands a connection back to the pool, or closes it if the pool is full.
+func (t *UDPTransport) putStream(address string, conn net.Conn) {
+	t.mutex.Lock()
+	select {
+	case <-t.closed:
+		t.mutex.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	if t.numStreams >= maxIdleStreams {
+		t.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	t.streams[address] = append(t.streams[address], idleStream{conn, time.Now()})
+	t.numStreams += 1
+	t.mutex.Unlock()
+}
+
+// Closes idle connections older than cutoff, or all of them if cutoff is
+// the zero time.
+func (t *UDPTransport) closeStreamsIdleSince(cutoff time.Time) {
+	expired := make([]net.Conn, 0)
+	t.mutex.Lock()
+	for address, streams := range t.streams {
+		kept := streams[:0]
+		for _, s := range streams {
+			if cutoff.IsZero() || s.since.Before(cutoff) {
+				expired = append(expired, s.conn)
+			} else {
+				kept = append(kept, s)
+			}
+		}
+		if len(kept) == 0 {
+			delete(t.streams, address)
+		} else {
+			t.streams[address] = kept
+		}
+	}
+	t.numStreams -= len(expired)
+	t.mutex.Unlock()
+
+	for _, conn := range expired {
+		conn.Close()
+	}
+}
+
+func (t *UDPTransport) reapStreams() {
+	ticker := time.NewTicker(streamIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed:
+			return
+		case now := <-ticker.C:
+			t.closeStreamsIdleSince(now.Add(-streamIdleTimeout))
+		}
+	}
+}
+
+func (t *UDPTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		t.mutex.Lock()
+		close(t.closed)
+		t.mutex.Unlock()
+		t.closeStreamsIdleSince(time.Time{})
+		if t.conn != nil {
+			err = t.conn.Close()
+			t.tcp.Close()
+		}
+	})
+	return err
+}
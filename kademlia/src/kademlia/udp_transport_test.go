@@ -0,0 +1,210 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newUDPNode(laddr string) *Kademlia {
+	config := DefaultConfig()
+	config.Transport = NewUDPTransport(20 * time.Millisecond)
+	config.RPCTimeout = time.Second
+	return NewKademliaWithConfig(laddr, config)
+}
+
+func TestWireEncoding(t *testing.T) {
+	sender, key := newTestSender(net.IPv4(127, 0, 0, 1), 9000)
+	other := Contact{NodeID: NewRandomID(), Host: net.ParseIP("2001:db8::1"), Port: 9001}
+	kad := newMemoryNode(NewMemoryNetwork(), "")
+	defer kad.Close()
+	kad.UpdateContactInKBucket(&other)
+	core := &KademliaCore{kad}
+
+	published := time.Now().Add(-time.Minute)
+	store := &StoreRequest{Sender: sender, MsgID: NewRandomID(), Key: NewRandomID(),
+		Value: []byte("value"), Publisher: NewRandomID(), Published: published, Cached: true}
+	signMessage(key, store)
+	msg, msgID, err := encodeRequest("KademliaCore.Store", store)
+	if err != nil || !msgID.Equals(store.MsgID) {
+		t.Fatal("TestWireEncoding: Encoding failed:", err)
+	}
+	resp, err := handleRequest(core, msg)
+	if err != nil {
+		t.Fatal("TestWireEncoding: Handling failed:", err)
+	}
+	var storeResult StoreResult
+	if _, err := decodeReply(resp, &storeResult); err != nil || !storeResult.MsgID.Equals(store.MsgID) {
+		t.Error("TestWireEncoding: STORE reply is wrong:", err)
+	}
+	if err := kad.verifyReply(store, &storeResult, &kad.SelfContact); err != nil {
+		t.Error("TestWireEncoding: STORE reply signature does not check out:", err)
+	}
+	rec, _, _ := kad.Table.Get(store.Key)
+	if !bytes.Equal(rec.Value, store.Value) || !rec.Publisher.Equals(store.Publisher) || !rec.Published.Equal(published) || !rec.Cached {
+		t.Error("TestWireEncoding: STORE arrived garbled")
+	}
+
+	find := &FindValueRequest{Sender: sender, MsgID: NewRandomID(), Key: NewRandomID()}
+	signMessage(key, find)
+	msg, _, _ = encodeRequest("KademliaCore.FindValue", find)
+	resp, _ = handleRequest(core, msg)
+	var findResult FindValueResult
+	if _, err := decodeReply(resp, &findResult); err != nil || findResult.Value != nil {
+		t.Fatal("TestWireEncoding: FIND_VALUE reply is wrong:", err)
+	}
+	if len(findResult.Nodes) != 1 || !findResult.Nodes[0].NodeID.Equals(other.NodeID) ||
+		!findResult.Nodes[0].Host.Equal(other.Host) || findResult.Nodes[0].Port != other.Port {
+		t.Error("TestWireEncoding: Contacts arrived garbled")
+	}
+	find.Key = store.Key
+	signMessage(key, find)
+	msg, _, _ = encodeRequest("KademliaCore.FindValue", find)
+	resp, _ = handleRequest(core, msg)
+	findResult = FindValueResult{}
+	if _, err := decodeReply(resp, &findResult); err != nil || !bytes.Equal(findResult.Value, store.Value) ||
+		!findResult.Publisher.Equals(store.Publisher) || !findResult.Published.Equal(published) {
+		t.Error("TestWireEncoding: FIND_VALUE reply with a value arrived garbled:", err)
+	}
+
+	// anything cut short is rejected rather than misread
+	for i := 0; i < len(msg); i++ {
+		if _, err := handleRequest(core, msg[:i]); err == nil {
+			t.Error("TestWireEncoding: Truncated message was accepted")
+			break
+		}
+	}
+}
+
+func TestUDPTransport(t *testing.T) {
+	kad1 := newUDPNode("localhost:9054")
+	kad2 := newUDPNode("localhost:9055")
+	defer kad1.Close()
+	defer kad2.Close()
+	ctx := context.Background()
+
+	pong, err := kad1.Ping(ctx, net.IPv4(127, 0, 0, 1), 9055)
+	if err != nil || !pong.NodeID.Equals(kad2.NodeID) {
+		t.Fatal("TestUDPTransport: Ping failed:", err)
+	}
+
+	// a value too large for a datagram is stored over TCP, and the reply
+	// to FIND_VALUE tells the caller to fetch it over TCP as well
+	key := NewRandomID()
+	value := bytes.Repeat([]byte("large"), 2*maxDatagramSize)
+	if err := kad1.Store(ctx, &kad2.SelfContact, key, value); err != nil {
+		t.Fatal("TestUDPTransport: Store of a large value failed:", err)
+	}
+	got, _, err := kad1.FindValue(ctx, &kad2.SelfContact, key)
+	if err != nil || !bytes.Equal(got, value) {
+		t.Error("TestUDPTransport: FindValue of a large value failed:", err)
+	}
+	contacts, err := kad2.FindNode(ctx, &kad1.SelfContact, NewRandomID())
+	if err != nil || len(contacts) != 0 {
+		t.Error("TestUDPTransport: FindNode failed:", err)
+	}
+}
+
+func TestUDPStreamReuse(t *testing.T) {
+	kad1 := newUDPNode("localhost:0")
+	kad2 := newUDPNode("localhost:0")
+	defer kad1.Close()
+	defer kad2.Close()
+	ctx := context.Background()
+	transport := kad1.transport.(*UDPTransport)
+	address := net.JoinHostPort(kad2.SelfContact.Host.String(), strconv.Itoa(int(kad2.SelfContact.Port)))
+
+	value := bytes.Repeat([]byte("large"), 2*maxDatagramSize)
+	if err := kad1.Store(ctx, &kad2.SelfContact, NewRandomID(), value); err != nil {
+		t.Fatal("TestUDPStreamReuse: Store failed:", err)
+	}
+	if len(transport.streams[address]) != 1 {
+		t.Fatal("TestUDPStreamReuse: Connection was not kept")
+	}
+	first := transport.streams[address][0].conn
+	if err := kad1.Store(ctx, &kad2.SelfContact, NewRandomID(), value); err != nil {
+		t.Fatal("TestUDPStreamReuse: Second Store failed:", err)
+	}
+	if transport.numStreams != 1 || transport.streams[address][0].conn != first {
+		t.Error("TestUDPStreamReuse: Connection was not reused")
+	}
+
+	// a broken idle connection is replaced rather than failing the call
+	first.Close()
+	if err := kad1.Store(ctx, &kad2.SelfContact, NewRandomID(), value); err != nil {
+		t.Error("TestUDPStreamReuse: Store over a broken connection failed:", err)
+	}
+	if transport.numStreams != 1 || transport.streams[address][0].conn == first {
+		t.Error("TestUDPStreamReuse: Broken connection was kept")
+	}
+}
+
+func TestUDPFindNodeFits(t *testing.T) {
+	kad1 := newUDPNode("localhost:0")
+	kad2 := newUDPNode("localhost:0")
+	defer kad1.Close()
+	defer kad2.Close()
+
+	// IPv6 contacts with public keys are the largest to encode
+	for i := 0; i < 4*kSize; i++ {
+		c, _ := newTestSender(net.ParseIP("2001:db8::1"), uint16(9000+i))
+		kad2.UpdateContactInKBucket(&c)
+	}
+	target := NewRandomID()
+	if n := len(kad2.FindCloseContacts(target, kad1.NodeID)); n < kSize {
+		t.Fatalf("TestUDPFindNodeFits: Only %d contacts in the table", n)
+	}
+
+	// without the TCP fallback, the reply has to come in one datagram
+	kad2.transport.(*UDPTransport).tcp.Close()
+	contacts, err := kad1.FindNode(context.Background(), &kad2.SelfContact, target)
+	if err != nil || len(contacts) != kSize {
+		t.Fatalf("TestUDPFindNodeFits: FindNode returned %d contacts: %v", len(contacts), err)
+	}
+}
+
+func TestUDPRetransmission(t *testing.T) {
+	kad1 := newUDPNode("localhost:9056")
+	kad2 := newUDPNode("localhost:9057")
+	defer kad1.Close()
+	defer kad2.Close()
+
+	// stands in for node 2 but drops the first copy of every request
+	lossy, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9058})
+	if err != nil {
+		t.Fatal("TestUDPRetransmission: Listen failed:", err)
+	}
+	defer lossy.Close()
+	go func() {
+		buf := make([]byte, 1<<16)
+		seen := make(map[ID]bool)
+		for {
+			n, addr, err := lossy.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, msgID, _, _ := readHeader(buf[:n])
+			if !seen[msgID] {
+				seen[msgID] = true
+				continue
+			}
+			reply, _ := handleRequest(&KademliaCore{kad2}, buf[:n])
+			lossy.WriteToUDP(reply, addr)
+		}
+	}()
+
+	pong, err := kad1.Ping(context.Background(), net.IPv4(127, 0, 0, 1), 9058)
+	if err != nil || !pong.NodeID.Equals(kad2.NodeID) {
+		t.Error("TestUDPRetransmission: Ping was not retransmitted:", err)
+	}
+
+	// nothing answers at all: the call times out
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := kad1.Ping(ctx, net.IPv4(127, 0, 0, 1), 9059); err == nil {
+		t.Error("TestUDPRetransmission: Ping to nobody succeeded")
+	}
+}
@@ -1,6 +1,7 @@
 package kademlia
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -8,12 +9,9 @@ import (
     "time"
 	mathrand "math/rand"
 	"sss"
-	"io/ioutil"
-	"strings"
 	"strconv"
-	"os"
-	"bufio"
 	"fmt"
+	"sync/atomic"
 )
 
 type VanishingDataObject struct {
@@ -78,7 +76,7 @@ func decrypt(key []byte, ciphertext []byte) (text []byte) {
 	return ciphertext
 }
 
-func VanishData(kadem Kademlia, data []byte, numberKeys byte, threshold byte, timeout int64) (string, VanishingDataObject) {
+func VanishData(ctx context.Context, kadem *Kademlia, data []byte, numberKeys byte, threshold byte, timeout int64) (string, VanishingDataObject) {
 	// copyData := copy()
 	var index int
 	K := GenerateRandomCryptoKey()
@@ -102,7 +100,7 @@ func VanishData(kadem Kademlia, data []byte, numberKeys byte, threshold byte, ti
 		// Checking for timeout every 0.1 seconds. 
 		// Probably can make this smaller for finer timeout
 		time.Sleep(100 * time.Millisecond)
-		if (time.Now().UnixNano() - kadem.LastTimeout) / 1000000000 > int64(timeout) {
+		if (time.Now().UnixNano() - atomic.LoadInt64(&kadem.LastTimeout)) / 1000000000 > int64(timeout) {
 			timeoutChan <- true
 		}
 	}()
@@ -110,7 +108,7 @@ func VanishData(kadem Kademlia, data []byte, numberKeys byte, threshold byte, ti
 	select {
 		// Timeout case
 	case <- timeoutChan:
-		_, old_data := UnvanishData(kadem, vdo) // First get the data again
+		_, old_data := UnvanishData(ctx, kadem, vdo) // First get the data again
 		new_K := GenerateRandomCryptoKey() // Repeat the process in the default case
 		new_C := encrypt(new_K, old_data)
 		new_split_map, _ := sss.Split(numberKeys, threshold, new_K)
@@ -126,7 +124,7 @@ func VanishData(kadem Kademlia, data []byte, numberKeys byte, threshold byte, ti
 		for k, v := range(new_split_map) {
 			new_data_to_store := append([]byte{k}, v...)
 			new_kadem_id := CopyID(new_ids[index])
-			DoIterativeStoreWithFile(new_kadem_id, new_data_to_store)
+			kadem.IterativeStoreOnce(ctx, new_kadem_id, new_data_to_store)
 			index += 1
 		}
 		fmt.Println("Shares size: " + strconv.Itoa(len(new_ids)))
@@ -138,26 +136,21 @@ func VanishData(kadem Kademlia, data []byte, numberKeys byte, threshold byte, ti
 		for key, value := range(split_map) {
 			data_to_store := append([]byte{key}, value...)
 			kadem_id := CopyID(ids[index])
-			/*
-			If our DoIterative functions from lab2 were working, we would
-			call them here. We are using local .txt files as an alternative.
-
-			store_result := kadem.DoIterativeStore(kadem_id, data_to_store)
-			*/
-			DoIterativeStoreWithFile(kadem_id, data_to_store)
 			//TODO : error detection, result interpretation of this store
+			kadem.IterativeStoreOnce(ctx, kadem_id, data_to_store)
 			index += 1
 
 		}
 	}
 
 	fmt.Println("Shares size: " + strconv.Itoa(len(ids)))
-	kadem.LastTimeout = time.Now().UnixNano()
+	// read by the timeout check above, which may still be running
+	atomic.StoreInt64(&kadem.LastTimeout, time.Now().UnixNano())
 
 	return "Vanished!", vdo
 }
 
-func UnvanishData(kadem Kademlia, vdo VanishingDataObject) (string, []byte) {
+func UnvanishData(ctx context.Context, kadem *Kademlia, vdo VanishingDataObject) (string, []byte) {
 	L := vdo.AccessKey
 	C := vdo.Ciphertext
 	N := vdo.NumberKeys
@@ -167,110 +160,21 @@ func UnvanishData(kadem Kademlia, vdo VanishingDataObject) (string, []byte) {
 
 	shares := make(map[byte][]byte)
 
-	index := 0 
-	for index <= int(thres) {
+	// collect shares until there are enough, skipping ones that are gone
+	for index := 0; index < len(ids) && len(shares) <= int(thres); index++ {
 		to_query := CopyID(ids[index])
-		/*
-		If our DoIterative* functions from lab2 were working, we would
-		call them here. We are using local .txt files as an alternative.
-
-		value := kadem.DoIterativeFindValue(to_query)
-		*/
-		value := DoIterativeFindValueWithFile(to_query)
+		value, _, err := kadem.IterativeFindValue(ctx, to_query)
+		if err != nil || len(value) == 0 {
+			continue
+		}
 
 		k_piece := value[0]
 		v_piece := value[1:]
 
 		shares[k_piece] = v_piece
-
-		index += 1
 	}
 	fmt.Println("Share size " + strconv.Itoa(len(shares)))
 	K := sss.Combine(shares)
 	decrypted_data := decrypt(K, C)
 	return "Unvanished!", decrypted_data
 }
-
-func DoIterativeStoreWithFile(key ID, value []byte) {
-	// check if file exists first
-	if fileExists(key) {
-		// open existing file
-		path := "./nodes/" + key.AsString() + ".txt"
-		f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0660)
-		handleError(err, "Cannot open file to append.")
-		// write value to end of file
-		text := "\n" + string(value)
-		appendToFileInVanish(f, text)
-		f.Close()
-	} else {
-		// create file with name of key
-		path := "./nodes/" + key.AsString() + ".txt"
-		f, err := os.Create(path)
-		handleError(err, "Error occurred in new file creation.")
-		// write value to file
-		text := string(value)
-		writeStringToFileInVanish(f, text)
-		f.Close()
-	}
-}
-
-func DoIterativeFindValueWithFile(key ID) []byte {
-	// open file
-	path := "./nodes/" + key.AsString() + ".txt"
-	// f, err := os.Open(path)
-	// handleError(err, "Error opening file.")
-	// lines := readLinesFromFileInVanish(f)
-	line := readFromFileInVanish(path)
-	return line
-}
-
-// error handler
-func handleError(e error, msg string) {
-	if e != nil {
-		fmt.Println(msg)
-		panic(e)
-	}
-}
-
-func fileExists(key ID) bool {
-	files, _ := ioutil.ReadDir("./nodes")
-	for _, f := range files {
-		s := strings.Split(f.Name(), ".")
-		if s[0] == key.AsString() {
-			return true
-		}
-	}
-	return false
-}
-
-func writeStringToFileInVanish(f *os.File, text string) {
-	writer := bufio.NewWriter(f)
-	_, err := writer.WriteString(text)
-	handleError(err, "Incomplete write to file")
-	err = writer.Flush()
-	handleError(err, "Flushing error.")
-}
-
-func readLinesFromFileInVanish(f *os.File) []string {
-	scanner := bufio.NewScanner(f)
-	list := make([]string, 0)
-	for scanner.Scan() {
-		list = append(list, scanner.Text())
-	}
-	return list
-}
-
-func appendToFileInVanish(f *os.File, s string) {
-	writer := bufio.NewWriter(f)
-	_, err := writer.WriteString(s)
-	handleError(err, "Error appending to file")
-	err = writer.Flush()
-	handleError(err, "Error flushing after append.")
-}
-
-func readFromFileInVanish(filename string) []byte {
-	b, err := ioutil.ReadFile(filename)
-	handleError(err, "Reading from file error.")
-	return b
-}
-
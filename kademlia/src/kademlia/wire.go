@@ -0,0 +1,427 @@
+package kademlia
+
+// Contains the binary encoding of the RPC messages. The UDP transport sends
+// messages in this encoding, and signatures are made over it.
+//
+// Every message starts with a header of a magic byte, a version byte, a type
+// byte and the 20 byte MsgID, and ends with its signature. All integers are
+// big endian and byte strings are prefixed with their length. Nodes are
+// encoded as NodeID, the length of the IP (0, 4 or 16), the IP and the port.
+// The sender of a request is a node followed by its public key; the nodes in
+// a reply go without theirs, so that k of them fit in a datagram, and are
+// checked against their NodeID once they answer. Times are nanoseconds
+// since the Unix epoch, 0 for the zero time.
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+const (
+	wireMagic   = byte(0x4b)
+	wireVersion = byte(5)
+	// magic, version, type and MsgID
+	wireHeaderSize = 3 + IDBytes
+)
+
+// Message types.
+const (
+	msgPing = byte(iota + 1)
+	msgPong
+	msgStore
+	msgStoreResult
+	msgFindNode
+	msgFindNodeResult
+	msgFindValue
+	msgFindValueResult
+	// the handler failed; the body is the error message
+	msgError
+	// the reply does not fit in a datagram; ask again over TCP
+	msgTooLarge
+)
+
+var errMalformed = errors.New("malformed message")
+
+type wireWriter struct {
+	buf []byte
+}
+
+func newWireWriter(typ byte, msgID ID) *wireWriter {
+	w := &wireWriter{make([]byte, 0, 256)}
+	w.buf = append(w.buf, wireMagic, wireVersion, typ)
+	w.id(msgID)
+	return w
+}
+
+func (w *wireWriter) bool(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *wireWriter) id(id ID) {
+	w.buf = append(w.buf, id[:]...)
+}
+
+func (w *wireWriter) uint16(n uint16) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, n)
+}
+
+func (w *wireWriter) uint32(n uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, n)
+}
+
+func (w *wireWriter) bytes(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *wireWriter) time(t time.Time) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(encodeTime(t)))
+}
+
+func (w *wireWriter) node(c Contact) {
+	w.id(c.NodeID)
+	ip := c.Host.To4()
+	if ip == nil {
+		ip = c.Host.To16()
+	}
+	w.buf = append(w.buf, byte(len(ip)))
+	w.buf = append(w.buf, ip...)
+	w.uint16(c.Port)
+}
+
+func (w *wireWriter) contact(c Contact) {
+	w.node(c)
+	w.bytes(c.PublicKey)
+}
+
+func (w *wireWriter) nodes(cs []Contact) {
+	w.uint16(uint16(len(cs)))
+	for _, c := range cs {
+		w.node(c)
+	}
+}
+
+// Reads a message. Any read past the end sets err and returns zero values.
+type wireReader struct {
+	buf []byte
+	err error
+}
+
+func (r *wireReader) next(n int) []byte {
+	if r.err != nil || n > len(r.buf) {
+		r.err = errMalformed
+		return make([]byte, n)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *wireReader) byte() byte {
+	return r.next(1)[0]
+}
+
+func (r *wireReader) bool() bool {
+	return r.byte() != 0
+}
+
+func (r *wireReader) id() (id ID) {
+	copy(id[:], r.next(IDBytes))
+	return
+}
+
+func (r *wireReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *wireReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+// Byte strings come back nil when empty, as they do from gob.
+func (r *wireReader) bytes() []byte {
+	n := r.uint32()
+	if r.err != nil || int(n) > len(r.buf) {
+		r.err = errMalformed
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.next(int(n)))
+	return b
+}
+
+func (r *wireReader) time() time.Time {
+	return decodeTime(int64(binary.BigEndian.Uint64(r.next(8))))
+}
+
+func (r *wireReader) node() (c Contact) {
+	c.NodeID = r.id()
+	n := int(r.byte())
+	if n != 0 && n != net.IPv4len && n != net.IPv6len {
+		r.err = errMalformed
+		return
+	}
+	if n > 0 {
+		c.Host = net.IP(append([]byte(nil), r.next(n)...))
+	}
+	c.Port = r.uint16()
+	return
+}
+
+func (r *wireReader) contact() Contact {
+	c := r.node()
+	c.PublicKey = r.bytes()
+	return c
+}
+
+func (r *wireReader) nodes() []Contact {
+	n := int(r.uint16())
+	cs := make([]Contact, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		cs = append(cs, r.node())
+	}
+	return cs
+}
+
+// Splits a message into its type, MsgID and body.
+func readHeader(msg []byte) (byte, ID, *wireReader, error) {
+	r := &wireReader{buf: msg}
+	if r.byte() != wireMagic || r.byte() != wireVersion {
+		return 0, ID{}, nil, errMalformed
+	}
+	typ := r.byte()
+	msgID := r.id()
+	return typ, msgID, r, r.err
+}
+
+// Encodes one of the RPC messages, which must be passed by pointer. The
+// signature is left out if signed is false, which gives the bytes it is
+// made over.
+func encodeMessage(msg interface{}, signed bool) ([]byte, error) {
+	var w *wireWriter
+	var sig []byte
+	switch m := msg.(type) {
+	case *PingMessage:
+		w = newWireWriter(msgPing, m.MsgID)
+		w.contact(m.Sender)
+		sig = m.Signature
+	case *PongMessage:
+		w = newWireWriter(msgPong, m.MsgID)
+		w.contact(m.Sender)
+		sig = m.Signature
+	case *StoreRequest:
+		w = newWireWriter(msgStore, m.MsgID)
+		w.contact(m.Sender)
+		w.id(m.Key)
+		w.buf = append(w.buf, byte(m.Hash))
+		w.id(m.Publisher)
+		w.time(m.Published)
+		w.bool(m.Cached)
+		w.bytes(m.Value)
+		sig = m.Signature
+	case *StoreResult:
+		w = newWireWriter(msgStoreResult, m.MsgID)
+		w.bytes(m.PublicKey)
+		sig = m.Signature
+	case *FindNodeRequest:
+		w = newWireWriter(msgFindNode, m.MsgID)
+		w.contact(m.Sender)
+		w.id(m.NodeID)
+		sig = m.Signature
+	case *FindNodeResult:
+		w = newWireWriter(msgFindNodeResult, m.MsgID)
+		w.bytes(m.PublicKey)
+		w.nodes(m.Nodes)
+		sig = m.Signature
+	case *FindValueRequest:
+		w = newWireWriter(msgFindValue, m.MsgID)
+		w.contact(m.Sender)
+		w.id(m.Key)
+		sig = m.Signature
+	case *FindValueResult:
+		w = newWireWriter(msgFindValueResult, m.MsgID)
+		w.bytes(m.PublicKey)
+		// an empty value means the same as none
+		if len(m.Value) > 0 {
+			w.buf = append(w.buf, 1)
+			w.id(m.Publisher)
+			w.time(m.Published)
+			w.bytes(m.Value)
+		} else {
+			w.buf = append(w.buf, 0)
+			w.nodes(m.Nodes)
+		}
+		sig = m.Signature
+	default:
+		return nil, errors.New("no binary encoding for message")
+	}
+	if signed {
+		w.bytes(sig)
+	}
+	return w.buf, nil
+}
+
+// Decodes a message encoded by encodeMessage, returning a pointer to it.
+func decodeMessage(buf []byte) (interface{}, error) {
+	typ, msgID, r, err := readHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	var msg interface{}
+	var sig *[]byte
+	switch typ {
+	case msgPing:
+		m := &PingMessage{MsgID: msgID}
+		m.Sender = r.contact()
+		msg, sig = m, &m.Signature
+	case msgPong:
+		m := &PongMessage{MsgID: msgID}
+		m.Sender = r.contact()
+		msg, sig = m, &m.Signature
+	case msgStore:
+		m := &StoreRequest{MsgID: msgID}
+		m.Sender = r.contact()
+		m.Key = r.id()
+		m.Hash = HashKind(r.byte())
+		m.Publisher = r.id()
+		m.Published = r.time()
+		m.Cached = r.bool()
+		m.Value = r.bytes()
+		msg, sig = m, &m.Signature
+	case msgStoreResult:
+		m := &StoreResult{MsgID: msgID}
+		m.PublicKey = r.bytes()
+		msg, sig = m, &m.Signature
+	case msgFindNode:
+		m := &FindNodeRequest{MsgID: msgID}
+		m.Sender = r.contact()
+		m.NodeID = r.id()
+		msg, sig = m, &m.Signature
+	case msgFindNodeResult:
+		m := &FindNodeResult{MsgID: msgID}
+		m.PublicKey = r.bytes()
+		m.Nodes = r.nodes()
+		msg, sig = m, &m.Signature
+	case msgFindValue:
+		m := &FindValueRequest{MsgID: msgID}
+		m.Sender = r.contact()
+		m.Key = r.id()
+		msg, sig = m, &m.Signature
+	case msgFindValueResult:
+		m := &FindValueResult{MsgID: msgID}
+		m.PublicKey = r.bytes()
+		if r.byte() == 1 {
+			m.Publisher = r.id()
+			m.Published = r.time()
+			m.Value = r.bytes()
+		} else {
+			m.Nodes = r.nodes()
+		}
+		msg, sig = m, &m.Signature
+	default:
+		return nil, errMalformed
+	}
+	*sig = r.bytes()
+	if r.err != nil || len(r.buf) != 0 {
+		return nil, errMalformed
+	}
+	return msg, nil
+}
+
+// Encodes the arguments of an outbound RPC. Returns the MsgID replies will
+// carry.
+func encodeRequest(method string, args interface{}) ([]byte, ID, error) {
+	buf, err := encodeMessage(args, true)
+	if err != nil {
+		return nil, ID{}, errors.New("no binary encoding for " + method)
+	}
+	_, msgID, _, _ := readHeader(buf)
+	return buf, msgID, nil
+}
+
+// Decodes a request, runs it on core and encodes the reply.
+func handleRequest(core *KademliaCore, buf []byte) ([]byte, error) {
+	msg, err := decodeMessage(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply interface{}
+	var msgID ID
+	switch req := msg.(type) {
+	case *PingMessage:
+		res := new(PongMessage)
+		reply, msgID, err = res, req.MsgID, core.Ping(*req, res)
+	case *StoreRequest:
+		res := new(StoreResult)
+		reply, msgID, err = res, req.MsgID, core.Store(*req, res)
+	case *FindNodeRequest:
+		res := new(FindNodeResult)
+		reply, msgID, err = res, req.MsgID, core.FindNode(*req, res)
+	case *FindValueRequest:
+		res := new(FindValueResult)
+		reply, msgID, err = res, req.MsgID, core.FindValue(*req, res)
+	default:
+		return nil, errMalformed
+	}
+
+	if err != nil {
+		w := newWireWriter(msgError, msgID)
+		w.buf = append(w.buf, err.Error()...)
+		return w.buf, nil
+	}
+	return encodeMessage(reply, true)
+}
+
+// Decodes a reply message into reply, which must be of the matching type.
+// Returns true if the reply has to be fetched over TCP instead.
+func decodeReply(buf []byte, reply interface{}) (bool, error) {
+	typ, _, r, err := readHeader(buf)
+	if err != nil {
+		return false, err
+	}
+	switch typ {
+	case msgTooLarge:
+		return true, nil
+	case msgError:
+		return false, rpc.ServerError(string(r.buf))
+	}
+
+	msg, err := decodeMessage(buf)
+	if err != nil {
+		return false, err
+	}
+	switch res := reply.(type) {
+	case *PongMessage:
+		if m, ok := msg.(*PongMessage); ok {
+			*res = *m
+			return false, nil
+		}
+	case *StoreResult:
+		if m, ok := msg.(*StoreResult); ok {
+			*res = *m
+			return false, nil
+		}
+	case *FindNodeResult:
+		if m, ok := msg.(*FindNodeResult); ok {
+			*res = *m
+			return false, nil
+		}
+	case *FindValueResult:
+		if m, ok := msg.(*FindValueResult); ok {
+			*res = *m
+			return false, nil
+		}
+	}
+	return false, errMalformed
+}
@@ -3,12 +3,11 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
-	"net"
-	"net/rpc"
 	"os"
 	"strconv"
 	"strings"
@@ -25,37 +24,60 @@ func main() {
 	// random numbers
 	rand.Seed(time.Now().UnixNano())
 
-	// Get the bind and connect connection strings from command-line arguments.
+	// Get the bind address and the seeds to join through from the command
+	// line. A peer given as second argument is used as a seed as well. With
+	// no seeds at all, this node starts a new network.
+	seedsStr := flag.String("seeds", "", "comma separated host:port addresses of nodes to join through")
+	dataDir := flag.String("data", "", "directory to keep the node key, contacts and values in across restarts")
+	difficulty := flag.Int("difficulty", 0, "leading zero bits node IDs must have in their hash; all nodes must agree")
+	transport := flag.String("transport", "http", "how to talk to other nodes: http or udp; all nodes must agree")
+	gateway := flag.Bool("gateway", false, "serve the REST gateway under /v1/ on the listen address; http transport only")
 	flag.Parse()
 	args := flag.Args()
-	if len(args) != 2 {
-		log.Fatal("Must be invoked with exactly two arguments!\n")
+	if len(args) < 1 || len(args) > 2 {
+		log.Fatal("Usage: main [-seeds host:port,...] listen_address [first_peer]\n")
 	}
 	listenStr := args[0]
-	firstPeerStr := args[1]
+	var seeds []string
+	if *seedsStr != "" {
+		seeds = strings.Split(*seedsStr, ",")
+	}
+	if len(args) == 2 {
+		seeds = append(seeds, args[1])
+	}
 
 	// Create the Kademlia instance
 	fmt.Printf("kademlia starting up!\n")
-	kadem := kademlia.NewKademlia(listenStr)
-
-	// Confirm our server is up with a PING request and then exit.
-	// Your code should loop forever, reading instructions from stdin and
-	// printing their results to stdout. See README.txt for more details.
-	_, port, _ := net.SplitHostPort(firstPeerStr)
-	client, err := rpc.DialHTTPPath("tcp", firstPeerStr, rpc.DefaultRPCPath+port)
-	if err != nil {
-		log.Fatal("DialHTTP: ", err)
+	config := kademlia.DefaultConfig()
+	config.DataDir = *dataDir
+	config.IDDifficulty = *difficulty
+	config.Gateway = *gateway
+	switch *transport {
+	case "http":
+	case "udp":
+		if *gateway {
+			log.Fatal("The gateway needs the http transport")
+		}
+		config.Transport = kademlia.NewUDPTransport(0)
+	default:
+		log.Fatal("Unknown transport: ", *transport)
 	}
+	kadem := kademlia.NewKademliaWithConfig(listenStr, config)
 
-	ping := new(kademlia.PingMessage)
-	ping.MsgID = kademlia.NewRandomID()
-	var pong kademlia.PongMessage
-	err = client.Call("KademliaCore.Ping", ping, &pong)
-	if err != nil {
-		log.Fatal("Call: ", err)
+	// contacts saved in the data directory are used as seeds as well
+	report, err := kadem.Bootstrap(context.Background(), seeds...)
+	for peer, err := range report.Failed {
+		log.Printf("seed %s did not respond: %v\n", peer, err)
+	}
+	if err != nil && len(seeds) > 0 {
+		log.Fatal("Bootstrap: ", err)
+	}
+	if len(report.Responded) == 0 {
+		log.Printf("no seeds responded, starting a new network\n")
+	}
+	for _, c := range report.Responded {
+		log.Printf("joined through %s\n", c.NodeID.AsString())
 	}
-	log.Printf("ping msgID: %s\n", ping.MsgID.AsString())
-	log.Printf("pong msgID: %s\n", pong.MsgID.AsString())
 
 	in := bufio.NewReader(os.Stdin)
 	quit := false
@@ -76,6 +98,7 @@ func main() {
 
 func executeLine(k *kademlia.Kademlia, line string) (response string) {
 	toks := strings.Fields(line)
+	ctx := context.Background()
 	switch {
 	case toks[0] == "quit":
 		response = "quit"
@@ -118,29 +141,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		id, err := kademlia.IDFromString(toks[1])
 		if err != nil {
-			hostname, portstr, err := net.SplitHostPort(toks[1])
-			if err != nil {
-				response = "ERR: Not a valid Node ID or host:port address"
-				return
-			}
-			port, err := strconv.Atoi(portstr)
+			host, port, err := kademlia.ResolveAddress(toks[1])
 			if err != nil {
 				response = "ERR: Not a valid Node ID or host:port address"
 				return
 			}
-			ipAddrStrings, err := net.LookupHost(hostname)
-			if err != nil {
-				response = "ERR: Could not find the provided hostname"
-				return
-			}
-			var host net.IP
-			for i := 0; i < len(ipAddrStrings); i++ {
-				host = net.ParseIP(ipAddrStrings[i])
-				if host.To4() != nil {
-					break
-				}
-			}
-			response = k.DoPing(host, uint16(port))
+			response = pingResponse(k.Ping(ctx, host, port))
 			return
 		}
 		c, err := k.FindContact(id)
@@ -148,7 +154,7 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Not a valid Node ID or host:port address"
 			return
 		}
-		response = k.DoPing(c.Host, c.Port)
+		response = pingResponse(k.Ping(ctx, c.Host, c.Port))
 
 	case toks[0] == "local_find_value":
 		// print a local variable
@@ -161,7 +167,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[1] + ")"
 			return
 		}
-		response = k.LocalFindValue(key)
+		value, err := k.LocalValue(key)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: " + string(value)
 
 	case toks[0] == "store":
 		// Store key, value pair at NodeID
@@ -186,7 +197,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		value := []byte(toks[3])
 
-		response = k.DoStore(contact, key, value)
+		err = k.Store(ctx, contact, key, value)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: Stored at " + contact.NodeID.AsString()
 
 	case toks[0] == "find_node":
 		// perform a find_node RPC
@@ -210,7 +226,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[2] + ")"
 			return
 		}
-		response = k.DoFindNode(contact, key)
+		nodes, err := k.FindNode(ctx, contact, key)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK:\n" + contactsString(nodes)
 
 	case toks[0] == "find_value":
 		// perform a find_value RPC
@@ -234,7 +255,16 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[2] + ")"
 			return
 		}
-		response = k.DoFindValue(contact, key)
+		value, nodes, err := k.FindValue(ctx, contact, key)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		if value == nil {
+			response = "OK: Value not found, closest contacts:\n" + contactsString(nodes)
+			return
+		}
+		response = "OK: " + string(value)
 
 	case toks[0] == "iterativeFindNode":
 		// perform an iterative find node
@@ -247,7 +277,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid node ID(" + toks[1] + ")"
 			return
 		}
-		response = k.DoIterativeFindNode(id)
+		contacts, err := k.IterativeFindNode(ctx, id)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK:\n" + contactsString(contacts)
 
 	case toks[0] == "iterativeStore":
 		// perform an iterative store
@@ -260,7 +295,16 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[2] + ")"
 			return
 		}
-		response = k.DoIterativeStore(key, []byte(toks[2]))
+		report, err := k.IterativeStore(ctx, key, []byte(toks[2]))
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: Stored at " + strconv.Itoa(len(report.Stored)) + " nodes\n"
+		response += contactsString(report.Stored)
+		for _, failure := range report.Failed {
+			response += "Failed at " + failure.Contact.NodeID.AsString() + ": " + failure.Err.Error() + "\n"
+		}
 
 	case toks[0] == "iterativeFindValue":
 		// performa an iterative find value
@@ -273,7 +317,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[1] + ")"
 			return
 		}
-		response = k.DoIterativeFindValue(key)
+		value, holder, err := k.IterativeFindValue(ctx, key)
+		if err != nil {
+			response = "ERR: " + err.Error()
+			return
+		}
+		response = "OK: \nID: " + holder.NodeID.AsString() + " \nValue: " + string(value)
 	case toks[0] == "vanish":
 		// perform vanish
 		if len(toks) != 6 {
@@ -287,7 +336,7 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		timeout, _ := strconv.ParseInt(toks[5], 10, 8)
 		k.LastTimeout = time.Now().UnixNano()
-		res, vdo := kademlia.VanishData(*k, []byte(toks[2]), byte(toks[3][0]), byte(toks[4][0]), timeout)
+		res, vdo := kademlia.VanishData(ctx, k, []byte(toks[2]), byte(toks[3][0]), byte(toks[4][0]), timeout)
 		response = res
 		k.Vdos[vdoID] = vdo
 
@@ -310,10 +359,27 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		// TODO: Not sure what to pass in as the vdo parameter to UnvanishData
 		//response = UnvanishData(k, )
 		vdo_to_pass := k.Vdos[vdoID]
-		res, data := kademlia.UnvanishData(*k, vdo_to_pass)
+		res, data := kademlia.UnvanishData(ctx, k, vdo_to_pass)
 		response = res + " Here is your data: " + string(data)
 	default:
 		response = "ERR: Unknown command"
 	}
 	return
 }
+
+func pingResponse(c kademlia.Contact, err error) string {
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	return "OK: Pong from " + c.NodeID.AsString()
+}
+
+func contactsString(contacts []kademlia.Contact) (response string) {
+	for i, c := range contacts {
+		response += "--Triple " + strconv.Itoa(i) + "--\n"
+		response += "NodeID = " + c.NodeID.AsString() + "\n"
+		response += "Host = " + c.Host.String() + "\n"
+		response += "Port = " + strconv.Itoa(int(c.Port)) + "\n"
+	}
+	return
+}